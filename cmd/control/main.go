@@ -1,21 +1,34 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/gopher9527/snowcast/pkg/kit"
+	"github.com/gopher9527/snowcast/pkg/logging"
 	"github.com/gopher9527/snowcast/pkg/protocol"
 )
 
-var numStations uint16 // number of stations
-var station = -1       // current station index
+var logger = logging.Logger("control")
+
+var numStations uint16          // number of stations
+var station = -1                // current station index, only used by the main goroutine
+var version = protocol.Version1 // protocol version agreed with the server
+var features uint32             // optional protocol features granted by the server
+var left bool                   // a Leave has been sent since the last SetStation, only used by the main goroutine
+var unanswered int              // pings sent to the server since its last Pong
+
+const maxUnanswered = 3 // pings left unanswered in a row before the server is given up on
 
 type Send struct {
 	commandType uint8 // type of the command that will be sent to the server
@@ -23,11 +36,41 @@ type Send struct {
 }
 
 func main() {
-	if len(os.Args) != 4 { // wrong number of arguments
+	ext := flag.Bool("ext", false, fmt.Sprintf("use the extended handshake of protocol version %d even if no optional feature is asked for", protocol.ProtocolVersion))
+	seq := flag.Bool("seq", false, "ask the server to put a sequence-numbered header in front of each UDP datagram, for snowcast_listener -seq")
+	register := flag.Bool("register", false, "let the listener register its address with the server instead of using udp_port, for snowcast_listener -register")
+	multicast := flag.Bool("multicast", false, "receive stations that have a multicast group from the group, for snowcast_listener -group")
+	keepalive := flag.Duration("keepalive", 0, fmt.Sprintf("ask for keepalive, answer the pings of the server and ping it this often, giving up after %d unanswered pings", maxUnanswered))
+	logLevel := flag.String("log-level", "info", `levels of log records to keep, e.g. "info" or "warn,control=debug"`)
+	logFormat := flag.String("log-format", "text", "text or json")
+	flag.Parse()
+	if flag.NArg() != 3 { // wrong number of arguments
 		// show the usage of the control
-		fmt.Println("usage: snowcast_control <server_name> <server_port> <udp_port>")
+		fmt.Println("usage: snowcast_control [-ext] [-seq] [-multicast] [-register] [-keepalive <interval>] [-log-level <levels>] [-log-format text|json] <server_name> <server_port> <udp_port>")
+		fmt.Println("commands: <station>, stations, leave, goodbye [reason], q")
 		return
 	}
+	level, components, err := logging.ParseLevels(*logLevel)
+	if err != nil {
+		logging.Fatal(logger, "invalid log level", "err", err)
+	}
+	err = logging.Setup(logging.Config{Format: *logFormat, Level: level, Components: components})
+	if err != nil {
+		logging.Fatal(logger, "invalid log format", "err", err)
+	}
+	var wanted uint32 // optional protocol features to ask for
+	if *seq {
+		wanted |= protocol.FeatureDataHeader
+	}
+	if *multicast {
+		wanted |= protocol.FeatureMulticast
+	}
+	if *register {
+		wanted |= protocol.FeatureRegister
+	}
+	if *keepalive > 0 {
+		wanted |= protocol.FeatureKeepalive
+	}
 
 	closeChan := make(chan int, 1)
 	sendChan := make(chan Send, 1)
@@ -41,14 +84,35 @@ func main() {
 	// catch Ctrl + C
 	signal.Notify(signalChan, os.Interrupt, syscall.SIGINT)
 
-	connect(os.Args[1], os.Args[2], os.Args[3], closeChan, socketChan, sendChan)
+	conn := connect(flag.Arg(0), flag.Arg(1), flag.Arg(2), *ext || wanted != 0, wanted, closeChan, socketChan, sendChan)
+
+	var pingChan <-chan time.Time // ticks when the server is due a ping, nil without keepalive
+	if features&protocol.FeatureKeepalive != 0 {
+		ticker := time.NewTicker(*keepalive)
+		defer ticker.Stop()
+		pingChan = ticker.C
+	}
+	var pingSeq uint32 // sequence number of the last ping
 
 	for {
 		// watch all channels, do something when an event happens
 		select {
 		case <-signalChan:
 			return
+		case <-pingChan:
+			if unanswered >= maxUnanswered {
+				logger.Error("the server did not answer pings, it may be gone", "unanswered", unanswered)
+				return
+			}
+			pingSeq++
+			unanswered++
+			sendChan <- Send{protocol.PingMessageType, pingSeq}
 		case a := <-socketChan: // input from socket
+			if p, ok := a.(*protocol.Ping); ok && features&protocol.FeatureKeepalive != 0 {
+				// answer with a Pong
+				sendChan <- Send{protocol.PongMessageType, p.Seq}
+				continue
+			}
 			ok := handleReply(a)
 			if !ok {
 				return
@@ -62,65 +126,157 @@ func main() {
 			case "stations":
 				// send a Stations command
 				sendChan <- Send{protocol.StationsCommandType, 0}
+			case "leave", "goodbye":
+				if version < protocol.Version4 {
+					fmt.Printf("The server does not support %s, try with -ext.\n", g[0])
+					continue
+				}
+				if g[0] == "leave" {
+					// stop listening and keep the connection open
+					sendChan <- Send{protocol.LeaveCommandType, 0}
+					// recorded when the command is queued, so the replies read by this goroutine are checked against it
+					station = -1
+					left = true
+					continue
+				}
+				// say goodbye with the rest of the line as the reason, then quit
+				sendGoodbye(conn, strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(cmd), "goodbye")))
+				closeChan <- 1
+				return
 			default:
 				s, err := strconv.ParseUint(cmd, 10, 16)
 				if err != nil || uint16(s) >= numStations {
 					// input is not a number or the number is outside the range given by the server
-					log.Println("invalid input")
+					logger.Warn("invalid input, type a station number between 0 and the number of stations", "input", cmd, "stations", numStations)
 					continue
 				}
 				// send a SetStation command with the user-provided station number
 				sendChan <- Send{protocol.SetStationCommandType, uint16(s)}
+				station = int(s)
+				left = false
 			}
 		}
 	}
 }
 
-func connect(serverName string, serverPort string, udpPort string, closeChan chan int, socketChan chan any, sendChan chan Send) {
-	conn, err := net.Dial("tcp4", fmt.Sprintf("%s:%s", serverName, serverPort))
+func connect(serverName string, serverPort string, udpPort string, ext bool, wanted uint32, closeChan chan int, socketChan chan any, sendChan chan Send) net.Conn {
+	conn, err := net.Dial("tcp", net.JoinHostPort(host(serverName), serverPort))
 	if err != nil {
-		log.Fatalln(err)
+		logging.Fatal(logger, "cannot connect to the server", "err", err)
 	}
-	handshake(conn, udpPort)
+	logger.Debug("connected", "server", conn.RemoteAddr().String(), "local", conn.LocalAddr().String())
+	handshake(conn, serverName, udpPort, ext, wanted)
 	// start a goroutine to wait for a message from the server
 	go listen(conn, closeChan, socketChan)
 	// start a goroutine to send messages to the server
 	go send(conn, closeChan, sendChan)
+	return conn
 }
 
-func handshake(conn net.Conn, udpPort string) {
+func handshake(conn net.Conn, serverName string, udpPort string, ext bool, wanted uint32) {
 	port, err := strconv.ParseUint(udpPort, 10, 16)
 	if err != nil {
-		log.Fatalln(err)
+		logging.Fatal(logger, "invalid UDP port", "port", udpPort, "err", err)
 	}
-	// build a hello message and send it
-	_, err = protocol.WriteMessage(conn, protocol.NewHello(uint16(port)))
+	// build a hello message and send it, an extended one only if asked for, so version 1 servers keep working
+	var hello protocol.Message = protocol.NewHello(uint16(port))
+	if ext {
+		hello = protocol.NewExtHello(uint16(port), protocol.ProtocolVersion, wanted)
+	}
+	err = protocol.NewEncoder(conn).Encode(context.Background(), hello)
 	if err != nil {
-		log.Fatalln(err)
+		logging.Fatal(logger, "cannot send the hello", "err", err)
 	}
 	// wait for a response
-	a, err := protocol.ReadMessage(conn, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	a, err := protocol.NewDecoder(conn).Decode(ctx)
 	if err != nil {
-		log.Fatalln(err)
+		if ext {
+			logging.Fatal(logger, diagnose(err), "hint", "the server may not support the extended handshake, try without -ext and other options")
+		}
+		logging.Fatal(logger, diagnose(err))
 	}
-	w, ok := a.(*protocol.Welcome) // conversion from any to Welcome
-	if !ok {
-		log.Fatalln(err)
+	switch w := a.(type) { // conversion from any to Welcome or ExtWelcome
+	case *protocol.Welcome:
+		numStations = w.NumStations
+	case *protocol.ExtWelcome:
+		numStations = w.NumStations
+		version = w.Version
+		features = w.Features
+		if wanted&protocol.FeatureDataHeader != 0 && features&protocol.FeatureDataHeader == 0 {
+			fmt.Println("The server does not send sequence-numbered datagrams.")
+		}
+		if wanted&protocol.FeatureMulticast != 0 && features&protocol.FeatureMulticast == 0 {
+			fmt.Println("The server does not multicast, song data goes to the UDP port.")
+		}
+		if wanted&protocol.FeatureKeepalive != 0 && features&protocol.FeatureKeepalive == 0 {
+			fmt.Println("The server does not support keepalive.")
+		}
+		if wanted&protocol.FeatureRegister != 0 && features&protocol.FeatureRegister == 0 {
+			fmt.Println("The server does not support registration, song data goes to the UDP port.")
+		}
+	case *protocol.InvalidCommand: // the server turned us away
+		logging.Fatal(logger, "connection refused", "reason", string(w.ReplyString))
+	case *protocol.LongString:
+		if w.GetType() == protocol.LongInvalidCommandReplyType {
+			logging.Fatal(logger, "connection refused", "reason", string(w.String))
+		}
+		logging.Fatal(logger, diagnose(&protocol.UnexpectedMessageError{Type: a.GetType(), State: "handshake"}))
+	default:
+		logging.Fatal(logger, diagnose(&protocol.UnexpectedMessageError{Type: a.GetType(), State: "handshake"}))
+	}
+	logger.Debug("handshake done", "version", version, "features", features)
+	fmt.Printf("Welcome to Snowcast! The server has `%d` stations.\n", numStations)
+	if features&protocol.FeatureRegister != 0 {
+		handleToken(conn, serverName)
 	}
-	fmt.Printf("Welcome to Snowcast! The server has `%d` stations.\n", w.NumStations)
-	numStations = w.NumStations // store the number of stations
+}
+
+// read the token that follows the welcome and tell the user how to register a listener with it
+func handleToken(conn net.Conn, serverName string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	a, err := protocol.NewDecoder(conn).Decode(ctx)
+	if err != nil {
+		logging.Fatal(logger, diagnose(err))
+	}
+	switch t := a.(type) {
+	case *protocol.Token:
+		address := net.JoinHostPort(host(serverName), strconv.Itoa(int(t.Port)))
+		fmt.Printf("Register a listener with: snowcast_listener -register %s -token %x\n", address, t.Token)
+	case *protocol.InvalidCommand: // the server turned us away
+		logging.Fatal(logger, "connection refused", "reason", string(t.ReplyString))
+	case *protocol.LongString:
+		if t.GetType() == protocol.LongInvalidCommandReplyType {
+			logging.Fatal(logger, "connection refused", "reason", string(t.String))
+		}
+		logging.Fatal(logger, diagnose(&protocol.UnexpectedMessageError{Type: a.GetType(), State: "handshake"}))
+	default:
+		logging.Fatal(logger, diagnose(&protocol.UnexpectedMessageError{Type: a.GetType(), State: "handshake"}))
+	}
+}
+
+// return the host of a server name, which is a host name, an IPv4 address or an IPv6 address with or without brackets, e.g. ::1 or [::1]
+func host(serverName string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(serverName, "["), "]")
 }
 
 func listen(conn net.Conn, closeChan chan int, socketChan chan any) {
 	defer conn.Close() // ensure the socket is closed when this goroutine exits
+	decoder := protocol.NewDecoder(conn)
 	for {
 		// watch the channel, do something when an event happens
 		select {
 		case <-closeChan:
 			return
 		default:
-			m, err := protocol.ReadMessage(conn, false)
-			if m == nil || err != nil {
+			m, err := decoder.Decode(context.Background())
+			if err != nil {
+				if err != io.EOF {
+					// pass it on, so the reason is shown
+					socketChan <- err
+				}
 				close(socketChan)
 				return
 			}
@@ -130,6 +286,10 @@ func listen(conn net.Conn, closeChan chan int, socketChan chan any) {
 }
 
 func handleReply(a any) bool {
+	if err, ok := a.(error); ok {
+		logger.Error(diagnose(err), "err", err)
+		return false
+	}
 	m, ok := a.(protocol.Message) // conversion from any to Messge
 	if !ok {
 		return false
@@ -144,35 +304,113 @@ func handleReply(a any) bool {
 		if !ok {
 			return false
 		}
-		return handleAnnounce(r)
+		return handleAnnounce(r.Songname)
 	case protocol.InvalidCommandReplyType:
 		r, ok := m.(*protocol.InvalidCommand) // conversion from Message to *InvalidCommand
 		if !ok {
 			return false
 		}
-		return handleInvalidCommand(r)
+		return handleInvalidCommand(r.ReplyString)
 	case protocol.StationsReplyType:
 		s, ok := m.(*protocol.StationsReply) // conversion from Message to *StationsReply
 		if !ok {
 			return false
 		}
-		return handleStationsReply(s)
-	default: // a Welcome or an unknown response was sent
-		fmt.Println("unknown reply")
+		return handleStationsReply(s.ReplyString)
+	case protocol.LongAnnounceReplyType:
+		l, ok := m.(*protocol.LongString) // conversion from Message to *LongString
+		if !ok {
+			return false
+		}
+		return handleAnnounce(l.String)
+	case protocol.LongInvalidCommandReplyType:
+		l, ok := m.(*protocol.LongString) // conversion from Message to *LongString
+		if !ok {
+			return false
+		}
+		return handleInvalidCommand(l.String)
+	case protocol.LongStationsReplyType:
+		l, ok := m.(*protocol.LongString) // conversion from Message to *LongString
+		if !ok {
+			return false
+		}
+		return handleStationsReply(l.String)
+	case protocol.GroupReplyType:
+		g, ok := m.(*protocol.Group) // conversion from Message to *Group
+		if !ok {
+			return false
+		}
+		return handleGroup(g.Address)
+	case protocol.PongMessageType:
+		unanswered = 0 // the server is still there
+		return true
+	case protocol.GoodbyeMessageType:
+		g, ok := m.(*protocol.Goodbye) // conversion from Message to *Goodbye
+		if !ok {
+			return false
+		}
+		return handleGoodbye(g.Reason)
+	default: // a Welcome or a command was sent
+		logger.Error(diagnose(&protocol.UnexpectedMessageError{Type: m.GetType(), State: "session"}))
 		return false
 	}
 }
 
-func handleAnnounce(a *protocol.Announce) bool {
+// explain why a reply of the server could not be handled
+func diagnose(err error) string {
+	var unknown *protocol.UnknownTypeError
+	var truncated *protocol.TruncatedError
+	var oversized *protocol.OversizedError
+	var timeout *protocol.TimeoutError
+	var unexpected *protocol.UnexpectedMessageError
+	switch {
+	case errors.As(err, &unknown):
+		return fmt.Sprintf("the server sent a reply of unknown type %d, it may speak a newer protocol version", unknown.Type)
+	case errors.As(err, &truncated):
+		return fmt.Sprintf("the connection closed in the middle of a reply of type %d after %d of %d bytes", truncated.Type, truncated.Got, truncated.Want)
+	case errors.As(err, &oversized):
+		return fmt.Sprintf("the server sent a reply of type %d with %d bytes, more than %d", oversized.Type, oversized.Size, oversized.Max)
+	case errors.As(err, &timeout) && timeout.Partial:
+		return "the server stopped sending in the middle of a reply"
+	case errors.As(err, &timeout):
+		return "the server did not reply in time, it may not be a Snowcast server"
+	case errors.As(err, &unexpected):
+		return fmt.Sprintf("the server sent a message of type %d, which is not expected during the %s", unexpected.Type, unexpected.State)
+	case err == io.EOF:
+		return "the server closed the connection"
+	}
+	return err.Error()
+}
+
+func handleAnnounce(songname []byte) bool {
+	if station == -1 && left { // the song changed just before the Leave arrived
+		return true
+	}
 	if station == -1 { // the server sends an Announce before the client has sent a SetStation
 		return false
 	}
-	fmt.Printf("New song announced: %s\n", a.Songname) // print to stdout
+	fmt.Printf("New song announced: %s\n", songname) // print to stdout
+	return true
+}
+
+func handleInvalidCommand(replyString []byte) bool {
+	fmt.Println(string(replyString)) // print to stdout
+	return false
+}
+
+// the server tells where the song data of the new station goes
+func handleGroup(address []byte) bool {
+	if len(address) == 0 {
+		fmt.Println("This station is sent to your UDP port.")
+	} else {
+		fmt.Printf("This station is multicast, listen with: snowcast_listener -group %s\n", address)
+	}
 	return true
 }
 
-func handleInvalidCommand(i *protocol.InvalidCommand) bool {
-	fmt.Println(string(i.ReplyString)) // print to stdout
+// the server is closing the connection
+func handleGoodbye(reason []byte) bool {
+	fmt.Printf("The server said goodbye: %s\n", reason) // print to stdout
 	return false
 }
 
@@ -192,6 +430,14 @@ func send(conn net.Conn, closeChan chan int, sendChan chan Send) {
 				sendSetStation(conn, s)
 			case protocol.StationsCommandType:
 				sendStationsCommand(conn)
+			case protocol.LeaveCommandType:
+				sendLeave(conn)
+			case protocol.PingMessageType, protocol.PongMessageType:
+				seq, ok := send.content.(uint32) // conversion from any to uint32
+				if !ok {
+					continue
+				}
+				sendKeepalive(conn, send.commandType, seq)
 			}
 		}
 	}
@@ -199,11 +445,42 @@ func send(conn net.Conn, closeChan chan int, sendChan chan Send) {
 
 func sendSetStation(conn net.Conn, s uint16) {
 	// build a SetStation message and send it
-	_, err := protocol.WriteMessage(conn, protocol.NewSetStation(s))
+	err := protocol.NewEncoder(conn).Encode(context.Background(), protocol.NewSetStation(s))
+	if err != nil {
+		logger.Error("cannot send a SetStation", "err", err)
+	}
+	logger.Debug("station changed", "station", s)
+}
+
+func sendLeave(conn net.Conn) {
+	// build a Leave message and send it
+	err := protocol.NewEncoder(conn).Encode(context.Background(), protocol.NewLeave())
+	if err != nil {
+		logger.Error("cannot send a Leave", "err", err)
+	}
+}
+
+// build a Ping or a Pong message and send it
+func sendKeepalive(conn net.Conn, messageType uint8, seq uint32) {
+	var m protocol.Message = protocol.NewPing(seq)
+	if messageType == protocol.PongMessageType {
+		m = protocol.NewPong(seq)
+	}
+	err := protocol.NewEncoder(conn).Encode(context.Background(), m)
+	if err != nil {
+		logger.Error("cannot send a keepalive message", "type", messageType, "err", err)
+	}
+}
+
+// build a Goodbye message and send it, the caller closes the connection
+func sendGoodbye(conn net.Conn, reason string) {
+	m, err := protocol.NewGoodbye(protocol.Truncate(reason, protocol.MaxStringSize))
+	if err == nil {
+		err = protocol.NewEncoder(conn).Encode(context.Background(), m)
+	}
 	if err != nil {
-		fmt.Println(err)
+		logger.Error("cannot send a Goodbye", "err", err)
 	}
-	station = int(s)
 }
 
 // ======================================== Extra Credit     ========================================
@@ -211,14 +488,15 @@ func sendSetStation(conn net.Conn, s uint16) {
 // send a command which requests a listing of what each of the stations is currently playing
 func sendStationsCommand(conn net.Conn) {
 	// build a StationsCommand message and send it
-	_, err := protocol.WriteMessage(conn, protocol.NewStationsCommand())
+	err := protocol.NewEncoder(conn).Encode(context.Background(), protocol.NewStationsCommand())
 	if err != nil {
-		fmt.Println(err)
+		logger.Error("cannot send a Stations command", "err", err)
 	}
 }
 
 // handle a reply which returns a listing of what each of the stations is currently playing
-func handleStationsReply(s *protocol.StationsReply) bool {
-	fmt.Println(string(s.ReplyString)) // just print the listing
+// a long listing comes in several replies, each one holding whole lines
+func handleStationsReply(replyString []byte) bool {
+	fmt.Print(string(replyString)) // just print the listing
 	return true
 }
@@ -1,28 +1,203 @@
 package main
 
 import (
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
+	"time"
+
+	"github.com/gopher9527/snowcast/pkg/logging"
+	"github.com/gopher9527/snowcast/pkg/protocol"
 )
 
+var logger = logging.Logger("listener")
+
 func main() {
-	if len(os.Args) != 2 { // wrong number of arguments
+	seq := flag.Bool("seq", false, "strip the data header of each datagram and report lost, reordered and duplicated datagrams, for snowcast_control -seq")
+	group := flag.String("group", "", "join a multicast group given as group:port instead of listening on a UDP port, for snowcast_control -multicast")
+	iface := flag.String("iface", "", "the network interface to join the multicast group on, e.g. lo, the system default if empty")
+	register := flag.String("register", "", "register with the server at host:port instead of listening on a UDP port, for snowcast_control -register")
+	token := flag.String("token", "", "the token printed by snowcast_control -register, in hexadecimal")
+	logLevel := flag.String("log-level", "info", `levels of log records to keep, e.g. "info" or "warn,listener=debug"`)
+	logFormat := flag.String("log-format", "text", "text or json")
+	flag.Parse()
+	level, components, err := logging.ParseLevels(*logLevel)
+	if err != nil {
+		logging.Fatal(logger, "invalid log level", "err", err)
+	}
+	err = logging.Setup(logging.Config{Format: *logFormat, Level: level, Components: components})
+	if err != nil {
+		logging.Fatal(logger, "invalid log format", "err", err)
+	}
+	if *group != "" && flag.NArg() == 0 {
+		join(*group, *iface, *seq)
+		return
+	}
+	if *register != "" && flag.NArg() == 0 {
+		registerAt(*register, *token, *seq)
+		return
+	}
+	if flag.NArg() != 1 { // wrong number of arguments
 		// show the usage of the listener
-		fmt.Println("usage: snowcast_listener <udp_port>")
+		fmt.Println("usage: snowcast_listener [-seq] [-log-level <levels>] [-log-format text|json] <udp_port>")
+		fmt.Println("       snowcast_listener [-seq] [-log-level <levels>] [-log-format text|json] [-iface <name>] -group <group:port>")
+		fmt.Println("       snowcast_listener [-seq] [-log-level <levels>] [-log-format text|json] -register <host:port> -token <token>")
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort("", flag.Arg(0)))
+	if err != nil {
+		logging.Fatal(logger, "invalid UDP port", "port", flag.Arg(0), "err", err)
+	}
+	// create a socket and bind it to the port on which we want to listen, on both IPv4 and IPv6
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		logging.Fatal(logger, "cannot listen for song data", "err", err)
+	}
+	logger.Debug("listening for song data", "address", conn.LocalAddr().String())
+	if !*seq {
+		// receives song data from the server and just writes it to stdout
+		copyOut(conn)
+		return
+	}
+	receive(conn, true)
+}
+
+const registerInterval = 15 * time.Second // how often the registration is sent again, so a NAT mapping does not time out
+
+// register with the server and write the song data it sends back to stdout
+// the server sends from the port registered with, so the song data gets through a NAT that let the registration out
+func registerAt(server string, token string, seq bool) {
+	t, err := hex.DecodeString(token)
+	if err != nil || len(t) != protocol.TokenSize {
+		logging.Fatal(logger, "invalid token, use the one printed by snowcast_control -register")
+	}
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		logging.Fatal(logger, "invalid registration address", "address", server, "err", err)
+	}
+	// a connected socket only receives datagrams from the server
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		logging.Fatal(logger, "cannot reach the registration port", "err", err)
+	}
+	go func() {
+		registration := protocol.MarshalRegistration(t)
+		for {
+			_, err := conn.Write(registration)
+			if err != nil {
+				logger.Warn("cannot send the registration", "err", err)
+			} else {
+				logger.Debug("registration sent", "server", addr.String())
+			}
+			time.Sleep(registerInterval)
+		}
+	}()
+	if !seq {
+		copyOut(conn)
 		return
 	}
-	addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf(":%s", os.Args[1]))
+	receive(conn, true)
+}
+
+// join a multicast group and write the song data sent to it to stdout
+// datagrams sent to a group always have a data header, gaps are only reported if track is set
+func join(group string, iface string, track bool) {
+	addr, err := net.ResolveUDPAddr("udp", group)
 	if err != nil {
-		log.Fatalln(err)
+		logging.Fatal(logger, "invalid multicast group", "group", group, "err", err)
+	}
+	var ifi *net.Interface
+	if iface != "" {
+		ifi, err = net.InterfaceByName(iface)
+		if err != nil {
+			logging.Fatal(logger, "invalid network interface", "iface", iface, "err", err)
+		}
+	}
+	conn, err := net.ListenMulticastUDP("udp", ifi, addr)
+	if err != nil {
+		logging.Fatal(logger, "cannot join the multicast group", "group", group, "err", err)
+	}
+	logger.Debug("joined multicast group", "group", group, "iface", iface)
+	receive(conn, track)
+}
+
+// receive datagrams with a data header and write their song data to stdout
+// if track is set, gaps are reported to stderr
+func receive(conn *net.UDPConn, track bool) {
+	var tracker tracker
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			logging.Fatal(logger, "cannot receive song data", "err", err)
+		}
+		header, data, err := protocol.ParseDataHeader(buf[:n])
+		if err != nil {
+			logger.Warn("datagram without a data header dropped", "size", n, "err", err)
+			continue
+		}
+		if track {
+			tracker.track(header)
+		}
+		_, err = os.Stdout.Write(data)
+		if err != nil {
+			logging.Fatal(logger, "cannot write song data", "err", err) // e.g. the player reading stdout has quit
+		}
 	}
-	// create a socket and bind it to the port on which we want to listen
-	conn, err := net.ListenUDP("udp4", addr)
+}
+
+// write the datagrams received on a socket to stdout as they are
+func copyOut(conn *net.UDPConn) {
+	_, err := io.Copy(os.Stdout, conn)
 	if err != nil {
-		log.Fatalln(err)
+		logging.Fatal(logger, "cannot pass song data on", "err", err)
+	}
+}
+
+const window = 64 // how many recent sequence numbers are remembered to tell duplicates from late datagrams
+
+// a struct to detect lost, reordered and duplicated datagrams of a station
+type tracker struct {
+	started   bool
+	stationID uint16
+	highest   uint32 // the highest sequence number received
+	seen      uint64 // bit i is set if highest-i has been received
+	lost      int    // datagrams missing so far, late ones are taken off when they arrive
+}
+
+func (t *tracker) track(h protocol.DataHeader) {
+	if !t.started || h.StationID != t.stationID {
+		// the first datagram or a new station, sequence numbers start over
+		if t.started {
+			logger.Info("switched station", "from", t.stationID, "to", h.StationID)
+		}
+		*t = tracker{started: true, stationID: h.StationID, highest: h.Seq, seen: 1}
+		return
+	}
+	switch {
+	case h.Seq > t.highest:
+		gap := h.Seq - t.highest - 1
+		if gap > 0 {
+			t.lost += int(gap)
+			logger.Warn("datagrams lost", "station", h.StationID, "lost", gap, "before", h.Seq, "total", t.lost)
+		}
+		if h.Seq-t.highest >= window {
+			t.seen = 0
+		} else {
+			t.seen <<= h.Seq - t.highest
+		}
+		t.seen |= 1
+		t.highest = h.Seq
+	case t.highest-h.Seq >= window:
+		logger.Warn("datagram too late", "station", h.StationID, "seq", h.Seq)
+	case t.seen&(1<<(t.highest-h.Seq)) != 0:
+		logger.Warn("datagram duplicated", "station", h.StationID, "seq", h.Seq)
+	default:
+		t.seen |= 1 << (t.highest - h.Seq)
+		t.lost--
+		logger.Warn("datagram out of order", "station", h.StationID, "seq", h.Seq)
 	}
-	// receives song data from the server and just writes it to stdout
-	io.Copy(os.Stdout, conn)
 }
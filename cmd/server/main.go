@@ -1,33 +1,130 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/gopher9527/snowcast/pkg/admin"
+	"github.com/gopher9527/snowcast/pkg/config"
+	"github.com/gopher9527/snowcast/pkg/gateway"
 	"github.com/gopher9527/snowcast/pkg/kit"
+	"github.com/gopher9527/snowcast/pkg/logging"
+	"github.com/gopher9527/snowcast/pkg/metrics"
 	"github.com/gopher9527/snowcast/pkg/protocol"
 )
 
+var logger = logging.Logger("server")
+
 var state *kit.State
+var keepalive = kit.DefaultKeepalive // how clients that asked for keepalive are checked
+var delivery = kit.DefaultDelivery   // how announcements reach clients that fall behind
+var registrar *kit.Registrar         // binds listeners that register to their clients, nil if registration is off
+
+var handshakeFailures = metrics.NewCounterVec("snowcast_handshake_failures_total", "Connections turned away before they became a client, by reason.", "reason")
+var invalidCommands = metrics.NewCounterVec("snowcast_invalid_commands_total", "InvalidCommand replies sent to clients, by reason.", "reason")
 
 func main() {
-	if len(os.Args) < 3 { // wrong number of arguments
+	configPath := flag.String("config", "", "read the listen address, stations, client limits and logging from a JSON file")
+	logLevel := flag.String("log-level", "", `levels of log records to keep, e.g. "info" or "warn,kit=debug", overrides the configuration file`)
+	logFormat := flag.String("log-format", "", "text or json, overrides the configuration file")
+	flag.Usage = func() {
 		// show the usage of the server
-		fmt.Println("usage: snowcast_server <tcpport> <file0> [file 1] [file 2] ...")
+		fmt.Println("usage: snowcast_server [-log-level <levels>] [-log-format text|json] <tcpport> <station0> [station 1] [station 2] ...")
+		fmt.Println("       snowcast_server [-log-level <levels>] [-log-format text|json] -config <file>")
+		fmt.Println("a station is a file, a directory or a comma-separated list of files and directories")
+	}
+	flag.Parse()
+
+	var addr string
+	var defs []kit.StationDef
+	var maxClients int
+	var maxListeners int                        // the maximum number of HTTP listeners, 0 means no limit
+	var httpAddr string                         // address of the HTTP streaming gateway, empty means no gateway
+	var adminAddr string                        // address of the admin JSON API, empty means no API
+	var adminToken string                       // the token requests to the admin API must carry
+	var adminDirs []string                      // directories the songs of stations added through the admin API must be in
+	var metricsAddr string                      // address of the metrics endpoint, empty means no metrics
+	var reload func() ([]kit.StationDef, error) // reread the station definitions
+	var err error
+	if *configPath != "" {
+		c, err := config.Load(*configPath)
+		if err != nil {
+			logging.Fatal(logger, "cannot load the configuration", "err", err)
+		}
+		reload = func() ([]kit.StationDef, error) {
+			c, err := config.Load(*configPath)
+			if err != nil {
+				return nil, err
+			}
+			return c.StationDefs()
+		}
+		setupLogging(c.Logging.File, or(*logLevel, c.Logging.Level), or(*logFormat, c.Logging.Format))
+		defs, err = c.StationDefs()
+		if err != nil {
+			logging.Fatal(logger, "cannot load the stations", "err", err)
+		}
+		addr = c.Listen
+		maxClients = c.Clients.Max
+		maxListeners = c.Clients.MaxHTTP
+		keepalive = c.Keepalive()
+		delivery = c.Delivery()
+		httpAddr = c.HTTP
+		adminAddr = c.Admin
+		adminToken = c.AdminToken
+		adminDirs = c.PlaylistDirs()
+		metricsAddr = c.Metrics
+		if c.Register != "" {
+			registrar, err = kit.NewRegistrar(c.Register)
+			if err != nil {
+				logging.Fatal(logger, "cannot listen for registrations", "address", c.Register, "err", err)
+			}
+			serverFeatures |= protocol.FeatureRegister
+			go registrar.Serve()
+		}
+	} else if flag.NArg() >= 2 {
+		setupLogging("", *logLevel, *logFormat)
+		reload = func() ([]kit.StationDef, error) {
+			// directories are read again, so their playlists pick up new files
+			return kit.ParseStationDefs(flag.Args()[1:])
+		}
+		defs, err = reload()
+		if err != nil {
+			logging.Fatal(logger, "cannot load the stations", "err", err)
+		}
+		addr = fmt.Sprintf(":%s", flag.Arg(0))
+	} else { // wrong number of arguments
+		flag.Usage()
 		return
 	}
 
-	state = kit.NewState(os.Args[2:])
+	state = kit.NewState(defs, maxClients)
+	state.SetDelivery(delivery)
+	state.SetMaxListeners(maxListeners)
 	// stations start even though no one is listening now
 	state.StartStations()
 
-	listen(os.Args[1])
+	listen(addr)
+	if httpAddr != "" {
+		serveHTTP(httpAddr)
+	}
+	if adminAddr != "" {
+		serveAdmin(adminAddr, adminToken, adminDirs)
+	}
+	if metricsAddr != "" {
+		serveMetrics(metricsAddr)
+	}
 
 	keyboardChan := make(chan string, 1)
 	// start a goroutine to read from keyboard
@@ -37,12 +134,18 @@ func main() {
 	// catch Ctrl + C
 	signal.Notify(signalChan, os.Interrupt, syscall.SIGINT)
 
+	reloadChan := make(chan os.Signal, 1)
+	// catch SIGHUP to reload the stations
+	signal.Notify(reloadChan, syscall.SIGHUP)
+
 	for {
-		// watch both channels, do something when an event happens
+		// watch all channels, do something when an event happens
 		select {
 		case <-signalChan:
 			state.Close()
 			return
+		case <-reloadChan:
+			reloadStations(reload)
 		case cmd := <-keyboardChan: // input from keyboard
 			g := strings.Fields(cmd)
 			switch g[0] {
@@ -54,10 +157,22 @@ func main() {
 					// write the list of stations to the specified file
 					file, err := os.Create(g[1])
 					if err != nil {
+						logger.Error("cannot write the list of stations", "err", err)
 						continue
 					}
-					go print(file)
+					go func() {
+						print(file)
+						err := file.Close()
+						if err != nil {
+							logger.Error("cannot write the list of stations", "err", err)
+						}
+					}()
 				}
+			case "s":
+				// print to stdout the rate, the lag and the skipped song data of each station and the number of evicted clients
+				go stats(os.Stdout)
+			case "r": // reread the station configuration
+				reloadStations(reload)
 			case "q": //  close all connections and exit
 				state.Close()
 				return
@@ -65,55 +180,225 @@ func main() {
 		}
 	}
 }
-func listen(tcpPort string) {
-	// get a TCPAddr and listen on the port number we specified on the command line
-	addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf(":%s", tcpPort))
+
+// send log records to a file, or to stderr if file is empty, keeping the levels of a spec such as "warn,kit=debug"
+func setupLogging(file, levels, format string) {
+	var c logging.Config
+	var err error
+	c.Level, c.Components, err = logging.ParseLevels(levels)
+	if err != nil {
+		logging.Fatal(logger, "invalid log level", "err", err)
+	}
+	c.Format = format
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			logging.Fatal(logger, "cannot open the log file", "err", err)
+		}
+		c.Output = f
+	}
+	err = logging.Setup(c)
+	if err != nil {
+		logging.Fatal(logger, "invalid log format", "err", err)
+	}
+}
+
+// return a if it is set, b otherwise
+func or(a, b string) string {
+	if a != "" {
+		return a
+	}
+	return b
+}
+
+func reloadStations(reload func() ([]kit.StationDef, error)) {
+	defs, err := reload()
+	if err != nil {
+		// keep the current stations if the new configuration is wrong
+		logger.Error("reload failed, the stations are unchanged", "err", err)
+		return
+	}
+	result, err := state.Reload(defs)
+	if err != nil {
+		logger.Error("reload failed, the stations are unchanged", "err", err)
+		return
+	}
+	logger.Info("stations reloaded", "result", result.String())
+}
+
+func listen(address string) {
+	// get a TCPAddr and listen on the address we specified on the command line or in the configuration file
+	// an address without a host, e.g. ":16800", listens on both IPv4 and IPv6
+	addr, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
-		log.Fatalln(err)
+		logging.Fatal(logger, "invalid listen address", "address", address, "err", err)
 	}
 	// create listen socket
-	listener, err := net.ListenTCP("tcp4", addr)
+	listener, err := net.ListenTCP("tcp", addr)
 	if err != nil {
-		log.Fatalln(err)
+		logging.Fatal(logger, "cannot listen for control connections", "address", address, "err", err)
 	}
+	logger.Info("listening for control connections", "address", listener.Addr().String())
 	go accept(listener)
 }
 
+// stream stations over HTTP at /stations/<n>
+func serveHTTP(address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		logging.Fatal(logger, "cannot listen for the HTTP gateway", "address", address, "err", err)
+	}
+	logger.Info("serving the HTTP gateway", "address", listener.Addr().String())
+	go func() {
+		err := http.Serve(listener, gateway.New(state))
+		logger.Error("HTTP gateway stopped", "err", err)
+	}()
+}
+
+// serve the admin JSON API, see pkg/admin for its endpoints
+func serveAdmin(address string, token string, dirs []string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		logging.Fatal(logger, "cannot listen for the admin API", "address", address, "err", err)
+	}
+	logger.Info("serving the admin API", "address", listener.Addr().String())
+	go func() {
+		err := http.Serve(listener, admin.New(state, token, dirs))
+		logger.Error("admin API stopped", "err", err)
+	}()
+}
+
+// serve the metrics of the server at /metrics in the Prometheus text format
+func serveMetrics(address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		logging.Fatal(logger, "cannot listen for the metrics endpoint", "address", address, "err", err)
+	}
+	logger.Info("serving metrics", "address", listener.Addr().String())
+	handler := metrics.Handler(func(w *metrics.Writer) {
+		state.Collect(w)
+		handshakeFailures.Collect(w)
+		invalidCommands.Collect(w)
+	})
+	go func() {
+		err := http.Serve(listener, handler)
+		logger.Error("metrics endpoint stopped", "err", err)
+	}()
+}
+
 func accept(listener *net.TCPListener) {
+	var id uint64 // correlation ID of the last connection, it tags every log record about the connection
 	for {
 		conn, err := listener.AcceptTCP() // wait for new connections
 		if err != nil {
+			logger.Warn("cannot accept a connection", "err", err)
 			continue
 		}
-		go handle(conn) // start a goroutine for the connection
+		id++
+		go handle(conn, logger.With("conn", id)) // start a goroutine for the connection
 	}
 }
 
-func handle(tcpConn net.Conn) {
-	udpConn, ok := handshake(tcpConn)
+func handle(tcpConn net.Conn, log *slog.Logger) {
+	// a client that stops reading must not hold its connection goroutine up, or announcements pile up behind it
+	tcpConn = kit.WithWriteTimeout(tcpConn, delivery.WriteTimeout)
+	log.Debug("connection accepted", "remote", tcpConn.RemoteAddr().String())
+	udpConn, version, features, ok := handshake(tcpConn, log)
 	if !ok {
 		tcpConn.Close()
 		return
 	}
 
-	client := state.AddClient(tcpConn, udpConn)
+	client, err := state.AddClient(tcpConn, udpConn, version, features)
+	if err != nil {
+		// the server is full, tell the client why it is turned away
+		handshakeFailures.Inc(label(err))
+		log.Info("handshake failed", "reason", label(err), "err", err)
+		sendInvalidCommand(tcpConn, version, err, log)
+		tcpConn.Close()
+		if udpConn != nil {
+			udpConn.Close()
+		}
+		return
+	}
+	log = log.With("client", client.ID)
+	udpAddr := "registered later"
+	if udpConn != nil {
+		udpAddr = udpConn.RemoteAddr().String()
+	}
+	log.Info("client connected", "remote", tcpConn.RemoteAddr().String(), "udp", udpAddr, "version", version, "features", features)
+
+	if features&protocol.FeatureRegister != 0 {
+		// give the client a token, song data is sent once its listener registers with it
+		defer registrar.Forget(client)
+		err := protocol.NewEncoder(tcpConn).Encode(context.Background(), protocol.NewToken(registrar.Port(), registrar.Token(client)))
+		if err != nil {
+			handshakeFailures.Inc("connection")
+			log.Info("handshake failed", "reason", "connection", "err", err)
+			tcpConn.Close()
+			state.RemoveClient(client)
+			return
+		}
+	}
 
 	closeChan := make(chan int, 1)
 	socketChan := make(chan any, 1)
 	// start a goroutine to wait for a message from the client
 	go message(tcpConn, closeChan, socketChan)
 
+	var pingChan <-chan time.Time // ticks when the client is due a ping, nil if it did not ask for keepalive
+	if client.Features&protocol.FeatureKeepalive != 0 && keepalive.Interval > 0 {
+		ticker := time.NewTicker(keepalive.Interval)
+		defer ticker.Stop()
+		pingChan = ticker.C
+	}
+	var seq uint32 // sequence number of the last ping
+	missed := 0    // pings sent since the last pong
+
 	for {
 		// watch all channels, do something when an event happens
 		select {
+		case <-pingChan:
+			if missed >= keepalive.Misses {
+				// the client is gone without closing the connection
+				log.Warn("client evicted", "reason", "keepalive timeout", "unanswered", missed)
+				if client.Version >= protocol.Version4 {
+					sendGoodbye(tcpConn, "keepalive timeout", log)
+				}
+				tcpConn.Close()
+				closeChan <- 1
+				state.Evict(client)
+				return
+			}
+			seq++
+			missed++
+			err := protocol.NewEncoder(tcpConn).Encode(context.Background(), protocol.NewPing(seq))
+			if err != nil {
+				log.Debug("cannot send a ping", "err", err) // a broken connection is noticed by the reading goroutine
+			}
 		case a := <-socketChan:
-			if a == nil {
+			if _, ok := a.(*protocol.Pong); ok && pingChan != nil {
+				// the client is still there
+				missed = 0
+				continue
+			}
+			if err, ok := a.(error); ok {
+				// the client sent something that is not a valid command, tell it what was wrong
+				log.Info("client disconnected", "reason", label(err), "err", err)
+				sendInvalidCommand(tcpConn, client.Version, err, log)
+				tcpConn.Close()
+				closeChan <- 1
+				state.RemoveClient(client)
+				return
+			} else if a == nil {
+				log.Info("client disconnected", "reason", "connection closed")
 				closeChan <- 1
 				state.RemoveClient(client)
 				return
 			} else {
-				ok := handleCommand(tcpConn, a, client)
+				ok := handleCommand(tcpConn, a, client, log)
 				if !ok {
+					log.Info("client disconnected", "reason", "command")
 					// close the connection right away in order to pass the test
 					// this may be because handleCommand function and channel are somewhat time consuming
 					tcpConn.Close()
@@ -123,13 +408,47 @@ func handle(tcpConn net.Conn) {
 				}
 			}
 		case songname := <-client.SongChan: // receive on the channel
-			_, err := protocol.WriteMessage(tcpConn, protocol.NewAnnounce(songname))
+			var err error
+			select {
+			case <-client.GroupChan: // the client was moved, the Group message goes before the Announce of the new station
+				err = sendGroup(tcpConn, client.Group())
+			default:
+			}
+			if err == nil {
+				err = sendAnnounce(tcpConn, client.Version, songname)
+			}
 			if err != nil {
+				log.Info("client disconnected", "reason", "cannot send an announce", "err", err)
 				closeChan <- 1
 				state.RemoveClient(client)
 				return
 			}
+		case <-client.GroupChan: // the client was moved or the group of its station has changed
+			group := client.Group()
+			err := sendGroup(tcpConn, group)
+			if err != nil {
+				log.Info("client disconnected", "reason", "cannot send a group", "err", err)
+				closeChan <- 1
+				state.RemoveClient(client)
+				return
+			}
+			log.Info("client told its group", "group", group)
+		case reason := <-client.KickChan:
+			log.Info("client kicked", "reason", reason)
+			if client.Version >= protocol.Version4 {
+				sendGoodbye(tcpConn, reason, log)
+			} else {
+				sendInvalidCommand(tcpConn, client.Version, kickError(reason), log)
+			}
+			tcpConn.Close()
+			closeChan <- 1
+			state.RemoveClient(client)
+			return
 		case <-client.CloseChan:
+			log.Info("client disconnected", "reason", "server shutting down")
+			if client.Version >= protocol.Version4 {
+				sendGoodbye(tcpConn, "server shutting down", log)
+			}
 			closeChan <- 1
 			state.RemoveClient(client)
 			return
@@ -137,41 +456,87 @@ func handle(tcpConn net.Conn) {
 	}
 }
 
-func handshake(tcpConn net.Conn) (net.Conn, bool) {
+// optional protocol features this server supports, FeatureRegister is added if registration is on
+var serverFeatures = protocol.FeatureDataHeader | protocol.FeatureKeepalive | protocol.FeatureMulticast
+
+func handshake(tcpConn net.Conn, log *slog.Logger) (net.Conn, uint8, uint32, bool) {
 	// try to read a message from the socket
-	a, err := protocol.ReadMessage(tcpConn, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	a, err := protocol.NewDecoder(tcpConn, protocol.WithMaxFrameSize(maxCommandSize)).Decode(ctx)
 	if err != nil {
-		return nil, false
+		if isProtocolError(err) {
+			handshakeFailures.Inc(label(err))
+			log.Info("handshake failed", "reason", label(err), "err", err)
+			sendInvalidCommand(tcpConn, protocol.Version1, err, log)
+		} else {
+			handshakeFailures.Inc("connection") // closed or reset before a hello was sent
+			log.Info("handshake failed", "reason", "connection", "err", err)
+		}
+		return nil, 0, 0, false
 	}
-	h, ok := a.(*protocol.Hello) // conversion from any to *Hello
-	if !ok {
-		return nil, false
+	var udpPort uint16
+	version := protocol.Version1
+	var features uint32
+	switch h := a.(type) { // conversion from any to *Hello or *ExtHello
+	case *protocol.Hello:
+		udpPort = h.UdpPort
+		// build a welcome message and send it
+		err = protocol.NewEncoder(tcpConn).Encode(context.Background(), protocol.NewWelcome(uint16(state.NumStations())))
+	case *protocol.ExtHello:
+		udpPort = h.UdpPort
+		version, features = protocol.Negotiate(h.Version, h.Features, protocol.ProtocolVersion, serverFeatures)
+		// build an extended welcome message and send it
+		err = protocol.NewEncoder(tcpConn).Encode(context.Background(), protocol.NewExtWelcome(uint16(state.NumStations()), version, features))
+	default:
+		err := &protocol.UnexpectedMessageError{Type: a.GetType(), State: "handshake"}
+		handshakeFailures.Inc(label(err))
+		log.Info("handshake failed", "reason", label(err), "err", err)
+		sendInvalidCommand(tcpConn, protocol.Version1, err, log)
+		return nil, 0, 0, false
+	}
+	if err != nil {
+		handshakeFailures.Inc("connection")
+		log.Info("handshake failed", "reason", "connection", "err", err)
+		return nil, 0, 0, false
+	}
+	if features&protocol.FeatureRegister != 0 {
+		return nil, version, features, true // the listener registers its address later
 	}
-	// build a welcome message and send it
-	protocol.WriteMessage(tcpConn, protocol.NewWelcome(uint16(len(state.Stations))))
+	// IPv6 addresses contain colons, so the host is split from the port by the rules of the address format
+	remoteIP, _, err := net.SplitHostPort(tcpConn.RemoteAddr().String())
 	if err != nil {
-		return nil, false
+		handshakeFailures.Inc("connection")
+		log.Info("handshake failed", "reason", "connection", "err", err)
+		return nil, 0, 0, false
 	}
-	remoteAddr := tcpConn.RemoteAddr()
-	remoteIP := strings.Split(remoteAddr.String(), ":")[0]
-	// create a connection to use for sending song data
-	udpConn, err := net.Dial("udp4", fmt.Sprintf("%s:%d", remoteIP, h.UdpPort))
+	// create a connection to use for sending song data, to the same address family the client connected with
+	udpConn, err := net.Dial("udp", net.JoinHostPort(remoteIP, strconv.Itoa(int(udpPort))))
 	if err != nil {
-		return nil, false
+		handshakeFailures.Inc("udp_dial")
+		log.Info("handshake failed", "reason", "udp_dial", "err", err)
+		return nil, 0, 0, false
 	}
-	return udpConn, true
+	return udpConn, version, features, true
 }
 
 func message(conn net.Conn, closeChan chan int, socketChan chan any) {
 	defer conn.Close() // ensure the socket is closed when this goroutine exits
+	decoder := protocol.NewDecoder(conn, protocol.WithMaxFrameSize(maxCommandSize))
 	for {
 		// watch the channel, do something when an event happens
 		select {
 		case <-closeChan:
 			return
 		default:
-			m, err := protocol.ReadMessage(conn, false)
+			m, err := decoder.Decode(context.Background())
 			if err != nil {
+				if isProtocolError(err) {
+					// pass it on and keep the socket open until the client has been told what was wrong
+					socketChan <- err
+					<-closeChan
+					return
+				}
 				close(socketChan)
 				return
 			}
@@ -180,31 +545,121 @@ func message(conn net.Conn, closeChan chan int, socketChan chan any) {
 	}
 }
 
-func handleCommand(conn net.Conn, a any, client *kit.Client) bool {
+func handleCommand(conn net.Conn, a any, client *kit.Client, log *slog.Logger) bool {
 	m, ok := a.(protocol.Message) // conversion from any to *Message
 	if !ok {
 		return false
 	}
 	switch m.GetType() {
 	// case protocol.HelloCommandType:
-	// 	protocol.WriteMessage(conn, protocol.NewInvalidCommand("Wrong"))
+	// 	protocol.NewEncoder(conn).Encode(context.Background(), protocol.NewInvalidCommand("Wrong"))
 	// 	return false
 	case protocol.SetStationCommandType:
 		s, ok := m.(*protocol.SetStation) // conversion from Message to *SetStation
 		if !ok {
 			return false
 		}
-		return handleSetStation(conn, *s, client)
+		return handleSetStation(conn, *s, client, log)
 	case protocol.StationsCommandType:
 		s, ok := m.(*protocol.StationsCommand) // conversion from Message to *StationsCommand
 		if !ok {
 			return false
 		}
 		return handleStationsCommand(conn, *s, client)
-	default: // a Hello or An unknown command was sent
-		protocol.WriteMessage(conn, protocol.NewInvalidCommand("invalid command"))
-		return false
+	case protocol.LeaveCommandType:
+		if client.Version < protocol.Version4 {
+			break
+		}
+		state.Leave(client)
+		log.Info("client left its station")
+		return true
+	case protocol.GoodbyeMessageType:
+		if client.Version < protocol.Version4 {
+			break
+		}
+		if g, ok := m.(*protocol.Goodbye); ok {
+			log.Info("client said goodbye", "reason", string(g.Reason))
+		}
+		return false // the client is leaving, close the connection
+	case protocol.PingMessageType:
+		p, ok := m.(*protocol.Ping) // conversion from Message to *Ping
+		if !ok || client.Features&protocol.FeatureKeepalive == 0 {
+			break
+		}
+		// build a Pong message and send it
+		return protocol.NewEncoder(conn).Encode(context.Background(), protocol.NewPong(p.Seq)) == nil
+	}
+	// a Hello, a reply or a command of a later version than the client agreed on was sent
+	sendInvalidCommand(conn, client.Version, &protocol.UnexpectedMessageError{Type: m.GetType(), State: "session"}, log)
+	return false
+}
+
+// the largest command a client sends, a Goodbye with the longest reason
+const maxCommandSize = 2 + protocol.MaxStringSize
+
+// report whether err is a mistake of the client rather than a closed or broken connection
+func isProtocolError(err error) bool {
+	return errors.Is(err, protocol.ErrUnknownType) || errors.Is(err, protocol.ErrTruncated) ||
+		errors.Is(err, protocol.ErrOversized) || errors.Is(err, protocol.ErrTimeout) || errors.Is(err, protocol.ErrUnexpected)
+}
+
+// return the text of the InvalidCommand sent to a client whose message could not be handled
+func reason(err error) string {
+	var unknown *protocol.UnknownTypeError
+	var truncated *protocol.TruncatedError
+	var oversized *protocol.OversizedError
+	var timeout *protocol.TimeoutError
+	var unexpected *protocol.UnexpectedMessageError
+	switch {
+	case errors.As(err, &unknown):
+		return fmt.Sprintf("unknown command type %d", unknown.Type)
+	case errors.As(err, &truncated):
+		return fmt.Sprintf("truncated command: %d of %d bytes received", truncated.Got, truncated.Want)
+	case errors.As(err, &oversized):
+		return fmt.Sprintf("command too large: %d bytes, at most %d allowed", oversized.Size, oversized.Max)
+	case errors.As(err, &timeout) && timeout.Partial:
+		return "timed out in the middle of a command"
+	case errors.As(err, &timeout):
+		return "timed out waiting for a hello"
+	case errors.As(err, &unexpected) && unexpected.State == "handshake":
+		return fmt.Sprintf("expected a hello, got a message of type %d", unexpected.Type)
+	case errors.As(err, &unexpected) && (unexpected.Type == protocol.HelloCommandType || unexpected.Type == protocol.ExtHelloCommandType):
+		return "more than one hello sent"
+	case errors.As(err, &unexpected):
+		return fmt.Sprintf("unexpected message of type %d, only commands are accepted", unexpected.Type)
 	}
+	return err.Error()
+}
+
+// return the reason an error is counted under in the metrics, a few fixed words rather than the text of reason
+func label(err error) string {
+	var kicked kickError
+	switch {
+	case errors.Is(err, protocol.ErrUnknownType):
+		return "unknown_type"
+	case errors.Is(err, protocol.ErrTruncated):
+		return "truncated"
+	case errors.Is(err, protocol.ErrOversized):
+		return "oversized"
+	case errors.Is(err, protocol.ErrTimeout):
+		return "timeout"
+	case errors.Is(err, protocol.ErrUnexpected):
+		return "unexpected_message"
+	case errors.Is(err, kit.ErrServerFull):
+		return "server_full"
+	case errors.Is(err, kit.ErrInvalidStation):
+		return "invalid_station"
+	case errors.As(err, &kicked):
+		return "kicked"
+	}
+	return "other"
+}
+
+// the reason an administrator gave for kicking a client
+type kickError string
+
+func (k kickError) Error() string {
+	return string(k)
 }
 
 // func handleHello(conn net.Conn, h protocol.Hello, client *kit.Client) bool {
@@ -212,38 +667,104 @@ func handleCommand(conn net.Conn, a any, client *kit.Client) bool {
 // 	return false
 // }
 
-func handleSetStation(conn net.Conn, s protocol.SetStation, client *kit.Client) bool {
-	if uint16(len(state.Stations)) <= s.StationNumber {
+func handleSetStation(conn net.Conn, s protocol.SetStation, client *kit.Client, log *slog.Logger) bool {
+	err := state.SetStation(int(s.StationNumber), client)
+	if err != nil {
 		// build a InvalidCommand message and send it
-		protocol.WriteMessage(conn, protocol.NewInvalidCommand("invalid station number"))
+		sendInvalidCommand(conn, client.Version, err, log)
+		return false
+	}
+	station, group := client.Station(), client.Group()
+	log.Info("station changed", "station", s.StationNumber, "name", station.Name, "group", group)
+	if client.Features&protocol.FeatureMulticast != 0 && sendGroup(conn, group) != nil {
 		return false
 	}
-	state.SetStation(int(s.StationNumber), client)
 	// build a Announce message and send it
-	_, err := protocol.WriteMessage(conn, protocol.NewAnnounce(client.Station.Songname))
-	return err == nil
+	return sendAnnounce(conn, client.Version, station.Song()) == nil
+}
+
+// build a Group message and send it, so the client knows where the song data goes
+func sendGroup(conn net.Conn, group string) error {
+	g, err := protocol.NewGroup(group)
+	if err != nil {
+		return err
+	}
+	return protocol.NewEncoder(conn).Encode(context.Background(), g)
+}
+
+// build an Announce message the client can read and send it
+// a song name too long for a version 1 client is truncated rather than corrupting the stream
+func sendAnnounce(conn net.Conn, version uint8, songname string) error {
+	m, err := protocol.AnnounceFor(version, songname)
+	if err != nil {
+		return err
+	}
+	err = protocol.NewEncoder(conn).Encode(context.Background(), m)
+	return err
+}
+
+// build a Goodbye message and send it, a reason too long for it is truncated
+// the connection is closed right after, so a failure is only logged
+func sendGoodbye(conn net.Conn, reason string, log *slog.Logger) {
+	m, err := protocol.NewGoodbye(protocol.Truncate(reason, protocol.MaxStringSize))
+	if err == nil {
+		err = protocol.NewEncoder(conn).Encode(context.Background(), m)
+	}
+	if err != nil {
+		log.Debug("cannot send a goodbye", "err", err)
+	}
+}
+
+// build an InvalidCommand message the client can read, telling it what was wrong, and send it
+// the connection is closed right after, so a failure is only logged
+func sendInvalidCommand(conn net.Conn, version uint8, cause error, log *slog.Logger) {
+	invalidCommands.Inc(label(cause))
+	m, err := protocol.InvalidCommandFor(version, reason(cause))
+	if err == nil {
+		err = protocol.NewEncoder(conn).Encode(context.Background(), m)
+	}
+	if err != nil {
+		log.Debug("cannot send an invalid command", "err", err)
+	}
 }
 
 func print(w io.Writer) {
 	// write the list of stations to the specified Writer
-	for i, station := range state.Stations {
-		fmt.Fprintf(w, "%d,%s", i, station.Songname)
-		for _, listener := range station.Listeners {
-			fmt.Fprintf(w, ",%s", listener.UdpConn.RemoteAddr())
+	for i, station := range state.Stations() {
+		fmt.Fprintf(w, "%d,%s", i, station.Song())
+		for _, listener := range station.Listeners() {
+			fmt.Fprintf(w, ",%s", listener.UdpAddr())
 		}
 		fmt.Fprintln(w)
 	}
 }
 
+func stats(w io.Writer) {
+	// write the rate, the lag and the skipped song data of each station to the specified Writer
+	for i, station := range state.Stations() {
+		fmt.Fprintf(w, "%d,%s,%d bytes/s,lag %v,skipped %v\n", i, station.Name, station.Rate(), station.Lag(), station.Skipped())
+	}
+	fmt.Fprintf(w, "%d clients evicted by keepalive\n", state.Evicted())
+}
+
 // ======================================== Extra Credit     ========================================
 
 func handleStationsCommand(conn net.Conn, s protocol.StationsCommand, client *kit.Client) bool {
 	// returns a listing of what each of the stations is currently playing
 	var result string
-	for i, station := range state.Stations {
-		result = fmt.Sprintf("%s%d %s\n", result, i, station.Songname)
+	for i, station := range state.Stations() {
+		result = fmt.Sprintf("%s%d %s\n", result, i, station.Song())
+	}
+	// build StationsReply messages and send them, a listing too long for one message is split between lines
+	replies, err := protocol.StationsRepliesFor(client.Version, result)
+	if err != nil {
+		return false
+	}
+	for _, reply := range replies {
+		err = protocol.NewEncoder(conn).Encode(context.Background(), reply)
+		if err != nil {
+			return false
+		}
 	}
-	// build a StationsReply message and send it
-	_, err := protocol.WriteMessage(conn, protocol.NewStationsReply(result))
-	return err == nil
+	return true
 }
@@ -1,3 +1,3 @@
 module github.com/gopher9527/snowcast
 
-go 1.19
+go 1.21
@@ -0,0 +1,337 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gopher9527/snowcast/pkg/config"
+	"github.com/gopher9527/snowcast/pkg/kit"
+	"github.com/gopher9527/snowcast/pkg/logging"
+)
+
+// a struct to serve the state of the server as JSON and let an administrator change it
+//
+//	GET    /stations              stations, their current tracks and their listeners
+//	POST   /stations              add a station, the body is {"name", "playlist", "bitrate", "multicast"}
+//	DELETE /stations/<n>          remove station n, its listeners are moved to the first station
+//	POST   /stations/<n>/skip     end the song station n is playing
+//	GET    /clients               all connected clients
+//	POST   /clients/<id>/kick     close the connection of a client, the body may be {"reason"}
+//	POST   /clients/<id>/move     move a client to another station, the body is {"station"}
+//
+// every request must carry "Authorization: Bearer <token>" and every body must be application/json, so a web page
+// cannot send requests to the API from a browser
+type Admin struct {
+	state *kit.State
+	token string   // the token every request must carry
+	dirs  []string // directories the songs of added stations must be in, cleaned and with symbolic links resolved
+}
+
+var logger = logging.Logger("admin")
+
+var (
+	errUnauthorized     = errors.New("missing or wrong token")
+	errNotJSON          = errors.New("the body must be application/json")
+	errOutsidePlaylists = errors.New("songs must be in the directories of the configured playlists")
+)
+
+// create the API with the token requests must carry and the directories the songs of added stations must be in
+func New(state *kit.State, token string, dirs []string) *Admin {
+	a := &Admin{state: state, token: token}
+	for _, dir := range dirs {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			continue
+		}
+		resolved, err = filepath.Abs(resolved)
+		if err != nil {
+			continue
+		}
+		a.dirs = append(a.dirs, resolved)
+	}
+	return a
+}
+
+// a struct to represent a station in JSON
+type Station struct {
+	Number    int      `json:"number"`    // the index used by SetStation, it changes when stations are removed
+	ID        uint16   `json:"id"`        // the ID in data headers, it does not change
+	Name      string   `json:"name"`      // unique name of the station
+	Song      string   `json:"song"`      // name of the song currently playing
+	File      string   `json:"file"`      // file of the song currently playing
+	Playlist  []string `json:"playlist"`  // files played by the station in order
+	Rate      int      `json:"rate"`      // bytes per second of the song currently playing
+	Lag       float64  `json:"lag"`       // seconds the station is behind its timeline, negative while it waits for the next chunk
+	Multicast string   `json:"multicast"` // multicast group of the station, empty if it has none
+	Listeners []Client `json:"listeners"` // clients listening to the station
+}
+
+// a struct to represent a client in JSON
+type Client struct {
+	ID        uint64    `json:"id"`
+	Control   string    `json:"control"`    // address of the control connection, empty for HTTP listeners
+	UDP       string    `json:"udp"`        // address song data is sent to
+	Station   *int      `json:"station"`    // number of the station the client listens to, null if none
+	Since     time.Time `json:"since"`      // when the client connected
+	BytesSent uint64    `json:"bytes_sent"` // bytes of song data sent to the client
+	Version   uint8     `json:"version"`    // protocol version agreed in the handshake
+	Features  uint32    `json:"features"`   // optional protocol features granted in the handshake
+}
+
+// a struct to represent a station to add in JSON
+type StationRequest struct {
+	Name      string   `json:"name"`
+	Playlist  []string `json:"playlist"`  // files and directories
+	Bitrate   int      `json:"bitrate"`   // kbit/s, 0 means the rate of each song
+	Multicast string   `json:"multicast"` // "group:port", empty means unicast only
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		a.writeError(w, http.StatusUnauthorized, errUnauthorized)
+		return
+	}
+	if r.ContentLength != 0 && !isJSON(r) {
+		a.writeError(w, http.StatusUnsupportedMediaType, errNotJSON)
+		return
+	}
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "stations" && r.Method == http.MethodGet:
+		a.writeJSON(w, http.StatusOK, a.stations())
+	case len(path) == 1 && path[0] == "stations" && r.Method == http.MethodPost:
+		a.addStation(w, r)
+	case len(path) == 2 && path[0] == "stations" && r.Method == http.MethodDelete:
+		a.station(w, r, path[1], "station removed", a.state.RemoveStation)
+	case len(path) == 3 && path[0] == "stations" && path[2] == "skip" && r.Method == http.MethodPost:
+		a.station(w, r, path[1], "song skipped", a.state.Skip)
+	case len(path) == 1 && path[0] == "clients" && r.Method == http.MethodGet:
+		a.writeJSON(w, http.StatusOK, a.clients())
+	case len(path) == 3 && path[0] == "clients" && path[2] == "kick" && r.Method == http.MethodPost:
+		a.kick(w, r, path[1])
+	case len(path) == 3 && path[0] == "clients" && path[2] == "move" && r.Method == http.MethodPost:
+		a.move(w, r, path[1])
+	default:
+		a.writeError(w, http.StatusNotFound, errors.New("no such endpoint"))
+	}
+}
+
+// check the bearer token of a request in constant time
+func (a *Admin) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && a.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+// check that the body of a request is declared as JSON, a body of unknown length counts as a body
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// check that every song of a playlist is in one of the directories of the configured playlists
+func (a *Admin) allowed(playlist []string) bool {
+	for _, song := range playlist {
+		resolved, err := filepath.EvalSymlinks(song)
+		if err == nil {
+			resolved, err = filepath.Abs(resolved)
+		}
+		if err != nil || !a.inDirs(resolved) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *Admin) inDirs(path string) bool {
+	for _, dir := range a.dirs {
+		rel, err := filepath.Rel(dir, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Admin) stations() []Station {
+	numbers := make(map[*kit.Station]int)
+	stations := a.state.Stations()
+	result := make([]Station, len(stations))
+	for i, station := range stations {
+		numbers[station] = i
+		result[i] = Station{
+			Number:    i,
+			ID:        station.ID,
+			Name:      station.Name,
+			Song:      station.Song(),
+			File:      station.File(),
+			Playlist:  station.Files(),
+			Rate:      station.Rate(),
+			Lag:       station.Lag().Seconds(),
+			Multicast: station.MulticastGroup(),
+			Listeners: []Client{},
+		}
+	}
+	for _, client := range a.state.Clients() {
+		if i, ok := numbers[client.Station()]; ok {
+			result[i].Listeners = append(result[i].Listeners, toClient(client, numbers))
+		}
+	}
+	return result
+}
+
+func (a *Admin) clients() []Client {
+	numbers := make(map[*kit.Station]int)
+	for i, station := range a.state.Stations() {
+		numbers[station] = i
+	}
+	result := []Client{}
+	for _, client := range a.state.Clients() {
+		result = append(result, toClient(client, numbers))
+	}
+	return result
+}
+
+func toClient(client *kit.Client, numbers map[*kit.Station]int) Client {
+	c := Client{
+		ID:        client.ID,
+		Control:   client.TcpAddr(),
+		UDP:       client.UdpAddr(),
+		Since:     client.Since,
+		BytesSent: client.Sent(),
+		Version:   client.Version,
+		Features:  client.Features,
+	}
+	if i, ok := numbers[client.Station()]; ok {
+		c.Station = &i
+	}
+	return c
+}
+
+func (a *Admin) addStation(w http.ResponseWriter, r *http.Request) {
+	var req StationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" || req.Bitrate < 0 {
+		a.writeError(w, http.StatusBadRequest, errors.New("a station needs a name and a bitrate that is not negative"))
+		return
+	}
+	if req.Multicast != "" {
+		err = config.ValidateGroup(req.Multicast)
+		if err != nil {
+			a.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	playlist, err := kit.NewPlaylist(req.Playlist...)
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// checked after directories are expanded, so a symbolic link in an allowed directory cannot lead out of it
+	if !a.allowed(playlist) {
+		a.writeError(w, http.StatusForbidden, errOutsidePlaylists)
+		return
+	}
+	err = a.state.AddStation(kit.StationDef{Name: req.Name, Playlist: playlist, ByteRate: req.Bitrate * 1000 / 8, Group: req.Multicast})
+	if err != nil {
+		a.writeError(w, http.StatusConflict, err)
+		return
+	}
+	logger.Info("station added", "name", req.Name, "songs", len(playlist), "remote", r.RemoteAddr)
+	a.writeJSON(w, http.StatusCreated, a.stations())
+}
+
+// run an action on the station numbered by a path segment and log it with a message
+func (a *Admin) station(w http.ResponseWriter, r *http.Request, number string, message string, action func(int) error) {
+	x, err := strconv.Atoi(number)
+	if err != nil {
+		a.writeError(w, http.StatusNotFound, kit.ErrInvalidStation)
+		return
+	}
+	err = action(x)
+	switch {
+	case errors.Is(err, kit.ErrInvalidStation):
+		a.writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		a.writeError(w, http.StatusConflict, err)
+	default:
+		logger.Info(message, "station", x, "remote", r.RemoteAddr)
+		a.writeJSON(w, http.StatusOK, a.stations())
+	}
+}
+
+func (a *Admin) kick(w http.ResponseWriter, r *http.Request, id string) {
+	body := struct {
+		Reason string `json:"reason"`
+	}{"kicked by the administrator"}
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			a.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err == nil {
+		err = a.state.Kick(n, body.Reason)
+	}
+	if err != nil {
+		a.writeError(w, http.StatusNotFound, kit.ErrNoSuchClient)
+		return
+	}
+	logger.Info("client kicked", "client", n, "reason", body.Reason, "remote", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) move(w http.ResponseWriter, r *http.Request, id string) {
+	var body struct {
+		Station *int `json:"station"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Station == nil {
+		a.writeError(w, http.StatusBadRequest, errors.New(`the body must be {"station": <n>}`))
+		return
+	}
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		a.writeError(w, http.StatusNotFound, kit.ErrNoSuchClient)
+		return
+	}
+	err = a.state.Move(n, *body.Station)
+	switch {
+	case errors.Is(err, kit.ErrNotListening):
+		a.writeError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		a.writeError(w, http.StatusNotFound, err)
+		return
+	}
+	logger.Info("client moved", "client", n, "station", *body.Station, "remote", r.RemoteAddr)
+	a.writeJSON(w, http.StatusOK, a.clients())
+}
+
+func (a *Admin) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(v)
+	if err != nil {
+		logger.Debug("cannot write a response", "err", err)
+	}
+}
+
+func (a *Admin) writeError(w http.ResponseWriter, status int, err error) {
+	a.writeJSON(w, status, map[string]string{"error": err.Error()})
+}
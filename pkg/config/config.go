@@ -0,0 +1,312 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gopher9527/snowcast/pkg/kit"
+	"github.com/gopher9527/snowcast/pkg/logging"
+)
+
+// a struct to represent the configuration file of the server
+type Config struct {
+	Listen     string    `json:"listen"`      // address to listen on for control connections, e.g. ":16800"
+	Register   string    `json:"register"`    // UDP address listeners register on, e.g. ":16801", empty means registration is off
+	HTTP       string    `json:"http"`        // address of the HTTP streaming gateway, e.g. ":8000", empty means no gateway
+	Admin      string    `json:"admin"`       // address of the admin JSON API, e.g. "127.0.0.1:16803", empty means no API
+	AdminToken string    `json:"admin_token"` // every admin API request must carry "Authorization: Bearer <token>", required with admin
+	Metrics    string    `json:"metrics"`     // address of the /metrics endpoint, e.g. ":9100", empty means no metrics
+	Stations   []Station `json:"stations"`    // all stations in order, the index is the station number
+	Clients    Clients   `json:"clients"`     // limits on control clients
+	Logging    Logging   `json:"logging"`     // where log messages go
+	path       string    // the file this configuration was loaded from
+}
+
+// a struct to represent a station in the configuration file
+type Station struct {
+	Name      string   `json:"name"`      // unique name of the station
+	Playlist  []string `json:"playlist"`  // files and directories played by the station in order
+	Bitrate   int      `json:"bitrate"`   // kbit/s, 0 means the rate of each song, or 16KiB/s if it is not MPEG audio
+	Multicast string   `json:"multicast"` // "group:port" the station is also sent to, e.g. "239.255.16.80:16801" or "[ff15::1680]:16801", empty means unicast only
+}
+
+type Clients struct {
+	Max          int    `json:"max"`           // the maximum number of connected control clients, 0 means no limit
+	MaxHTTP      int    `json:"max_http"`      // the maximum number of listeners of the HTTP gateway, 0 means no limit
+	PingInterval string `json:"ping_interval"` // e.g. "5s", time between pings to clients that asked for keepalive, empty means 5s, "0s" turns pings off
+	PingMisses   int    `json:"ping_misses"`   // unanswered pings in a row before a client is evicted, 0 means 3
+	WriteTimeout string `json:"write_timeout"` // e.g. "5s", how long a write to a control connection may block before the client is dropped, empty means 5s, "0s" means no limit
+	// e.g. "10s", how long an announcement may wait for a client to take it before the client is kicked, empty means 10s, "0s" means no limit
+	AnnounceTimeout string `json:"announce_timeout"`
+}
+
+type Logging struct {
+	File   string `json:"file"`   // append log messages to this file instead of stderr
+	Level  string `json:"level"`  // e.g. "info" or "warn,kit=debug", a level for all components then levels of single ones, empty means info
+	Format string `json:"format"` // "text" or "json", empty means text
+}
+
+// a error to report where a configuration file is wrong
+type Error struct {
+	Path  string // the configuration file
+	Line  int    // line in the file, 0 if the error is about a field
+	Field string // field in the file, e.g. stations[1].playlist, empty if the error is about a line
+	Err   error
+}
+
+func (e *Error) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%s: %s: %v", e.Path, e.Field, e.Err)
+	}
+	return fmt.Sprintf("%s:%d: %v", e.Path, e.Line, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// read, parse and validate a configuration file
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := Config{path: path}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields() // a misspelled field is an error rather than silently ignored
+	err = decoder.Decode(&c)
+	if err != nil {
+		return nil, decodeError(path, data, decoder, err)
+	}
+	if decoder.More() {
+		return nil, &Error{Path: path, Line: line(data, decoder.InputOffset()), Err: errors.New("unexpected data after the configuration")}
+	}
+	err = c.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// convert an error of the json package into an Error with a line number or a field
+func decodeError(path string, data []byte, decoder *json.Decoder, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return &Error{Path: path, Line: line(data, syntaxErr.Offset), Err: err}
+	case errors.As(err, &typeErr):
+		return &Error{Path: path, Field: fieldName(typeErr.Field), Err: fmt.Errorf("cannot use %s as %s", typeErr.Value, typeErr.Type)}
+	case err == io.EOF:
+		return &Error{Path: path, Line: 1, Err: errors.New("empty configuration")}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// the json package reports unknown fields without an offset, so look for the quoted name used as a key
+		name := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		offset := len(data)
+		if loc := regexp.MustCompile(regexp.QuoteMeta(name) + `\s*:`).FindIndex(data); loc != nil {
+			offset = loc[0]
+		}
+		return &Error{Path: path, Line: line(data, int64(offset)), Err: fmt.Errorf("unknown field %s", name)}
+	default: // unexpected end of input
+		return &Error{Path: path, Line: line(data, decoder.InputOffset()), Err: err}
+	}
+}
+
+// the json package names an element of an array with a dot, e.g. stations.0.bitrate
+var index = regexp.MustCompile(`\.(\d+)`)
+
+// return the name of a field the way validate names it, e.g. stations[0].bitrate
+func fieldName(field string) string {
+	return index.ReplaceAllString(field, "[$1]")
+}
+
+// return the line number of a byte offset
+func line(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+func (c *Config) validate() error {
+	if c.Listen == "" {
+		return &Error{Path: c.path, Field: "listen", Err: errors.New("missing")}
+	}
+	_, port, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return &Error{Path: c.path, Field: "listen", Err: err}
+	}
+	_, err = strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return &Error{Path: c.path, Field: "listen", Err: fmt.Errorf("invalid port %q", port)}
+	}
+	for _, a := range []struct{ field, value string }{
+		{"register", c.Register},
+		{"http", c.HTTP},
+		{"admin", c.Admin},
+		{"metrics", c.Metrics},
+	} {
+		if a.value == "" {
+			continue // optional
+		}
+		_, port, err := net.SplitHostPort(a.value)
+		if err != nil {
+			return &Error{Path: c.path, Field: a.field, Err: err}
+		}
+		_, err = strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return &Error{Path: c.path, Field: a.field, Err: fmt.Errorf("invalid port %q", port)}
+		}
+	}
+	if c.Admin != "" && len(c.AdminToken) < 16 {
+		return &Error{Path: c.path, Field: "admin_token", Err: errors.New("the admin API needs a token of at least 16 characters")}
+	}
+	if len(c.Stations) == 0 {
+		return &Error{Path: c.path, Field: "stations", Err: errors.New("at least one station is required")}
+	}
+	names := make(map[string]int)
+	for i, station := range c.Stations {
+		field := fmt.Sprintf("stations[%d]", i)
+		if station.Name == "" {
+			return &Error{Path: c.path, Field: field + ".name", Err: errors.New("missing")}
+		}
+		if j, ok := names[station.Name]; ok {
+			return &Error{Path: c.path, Field: field + ".name", Err: fmt.Errorf("%q is already used by stations[%d]", station.Name, j)}
+		}
+		names[station.Name] = i
+		if len(station.Playlist) == 0 {
+			return &Error{Path: c.path, Field: field + ".playlist", Err: errors.New("at least one file or directory is required")}
+		}
+		if station.Bitrate < 0 {
+			return &Error{Path: c.path, Field: field + ".bitrate", Err: errors.New("must not be negative")}
+		}
+		if station.Multicast != "" {
+			err := ValidateGroup(station.Multicast)
+			if err != nil {
+				return &Error{Path: c.path, Field: field + ".multicast", Err: err}
+			}
+		}
+	}
+	if c.Clients.Max < 0 {
+		return &Error{Path: c.path, Field: "clients.max", Err: errors.New("must not be negative")}
+	}
+	if c.Clients.MaxHTTP < 0 {
+		return &Error{Path: c.path, Field: "clients.max_http", Err: errors.New("must not be negative")}
+	}
+	for _, d := range []struct{ field, value string }{
+		{"clients.ping_interval", c.Clients.PingInterval},
+		{"clients.write_timeout", c.Clients.WriteTimeout},
+		{"clients.announce_timeout", c.Clients.AnnounceTimeout},
+	} {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return &Error{Path: c.path, Field: d.field, Err: err}
+		}
+		if duration < 0 {
+			return &Error{Path: c.path, Field: d.field, Err: errors.New("must not be negative")}
+		}
+	}
+	if c.Clients.PingMisses < 0 {
+		return &Error{Path: c.path, Field: "clients.ping_misses", Err: errors.New("must not be negative")}
+	}
+	_, _, err = logging.ParseLevels(c.Logging.Level)
+	if err != nil {
+		return &Error{Path: c.path, Field: "logging.level", Err: err}
+	}
+	if c.Logging.Format != "" && c.Logging.Format != "text" && c.Logging.Format != "json" {
+		return &Error{Path: c.path, Field: "logging.format", Err: fmt.Errorf("unknown format %q, use text or json", c.Logging.Format)}
+	}
+	return nil
+}
+
+// return how clients that asked for keepalive are checked, defaults fill in missing fields
+func (c *Config) Keepalive() kit.Keepalive {
+	keepalive := kit.DefaultKeepalive
+	if c.Clients.PingInterval != "" {
+		keepalive.Interval, _ = time.ParseDuration(c.Clients.PingInterval) // checked by validate
+	}
+	if c.Clients.PingMisses > 0 {
+		keepalive.Misses = c.Clients.PingMisses
+	}
+	return keepalive
+}
+
+// return how announcements reach clients that fall behind, defaults fill in missing fields
+func (c *Config) Delivery() kit.Delivery {
+	delivery := kit.DefaultDelivery
+	if c.Clients.WriteTimeout != "" {
+		delivery.WriteTimeout, _ = time.ParseDuration(c.Clients.WriteTimeout) // checked by validate
+	}
+	if c.Clients.AnnounceTimeout != "" {
+		delivery.MaxPending, _ = time.ParseDuration(c.Clients.AnnounceTimeout) // checked by validate
+	}
+	return delivery
+}
+
+// check that a multicast address is a multicast IP literal and a port
+func ValidateGroup(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsMulticast() {
+		return fmt.Errorf("%q is not a multicast IP address", host)
+	}
+	_, err = strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// return the directories the playlists of the stations are in: the directories listed and those of the files listed
+// the admin API only adds stations with songs from these directories
+func (c *Config) PlaylistDirs() []string {
+	var dirs []string
+	for _, station := range c.Stations {
+		for _, path := range station.Playlist {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue // reported by StationDefs
+			}
+			if !info.IsDir() {
+				path = filepath.Dir(path)
+			}
+			dirs = append(dirs, path)
+		}
+	}
+	return dirs
+}
+
+// build the station definitions, expanding directories into their files
+func (c *Config) StationDefs() ([]kit.StationDef, error) {
+	defs := make([]kit.StationDef, len(c.Stations))
+	for i, station := range c.Stations {
+		for j, path := range station.Playlist {
+			_, err := os.Stat(path)
+			if err != nil {
+				return nil, &Error{Path: c.path, Field: fmt.Sprintf("stations[%d].playlist[%d]", i, j), Err: err}
+			}
+		}
+		playlist, err := kit.NewPlaylist(station.Playlist...)
+		if err != nil {
+			return nil, &Error{Path: c.path, Field: fmt.Sprintf("stations[%d].playlist", i), Err: err}
+		}
+		defs[i] = kit.StationDef{Name: station.Name, Playlist: playlist, ByteRate: station.Bitrate * 1000 / 8, Group: station.Multicast}
+	}
+	return defs, nil
+}
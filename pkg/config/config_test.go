@@ -0,0 +1,69 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// errors of a configuration file name a field the same way, whether decoding or validating it fails
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		field string // the field of the Error, empty if it is about a line
+		line  int
+	}{
+		{"type error", `{"listen": ":16800", "stations": [{"name": "a", "playlist": ["a.mp3"], "bitrate": "fast"}]}`,
+			"stations[0].bitrate", 0},
+		{"negative bitrate", `{"listen": ":16800", "stations": [{"name": "a", "playlist": ["a.mp3"], "bitrate": -1}]}`,
+			"stations[0].bitrate", 0},
+		{"type error of the second station", `{"listen": ":16800", "stations": [{"name": "a", "playlist": ["a.mp3"]}, {"name": "b", "playlist": "b.mp3"}]}`,
+			"stations[1].playlist", 0},
+		{"missing playlist of the second station", `{"listen": ":16800", "stations": [{"name": "a", "playlist": ["a.mp3"]}, {"name": "b"}]}`,
+			"stations[1].playlist", 0},
+		{"type error of a nested field", `{"listen": ":16800", "stations": [{"name": "a", "playlist": ["a.mp3"]}], "clients": {"max": "ten"}}`,
+			"clients.max", 0},
+		{"duplicate name", `{"listen": ":16800", "stations": [{"name": "a", "playlist": ["a.mp3"]}, {"name": "a", "playlist": ["b.mp3"]}]}`,
+			"stations[1].name", 0},
+		{"bad address", `{"listen": ":16800", "http": "8000", "stations": [{"name": "a", "playlist": ["a.mp3"]}]}`,
+			"http", 0},
+		{"unknown field", "{\n  \"listen\": \"bogus:1\",\n  \"stations\": [],\n  \"bogus\": 1\n}", "", 4},
+		{"syntax error", "{\n  \"listen\": \":16800\",\n  \"stations\": [}\n", "", 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "server.json")
+			err := os.WriteFile(path, []byte(test.json), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = Load(path)
+			var configErr *Error
+			if !errors.As(err, &configErr) {
+				t.Fatalf("got %v, want an Error", err)
+			}
+			if configErr.Field != test.field || configErr.Line != test.line {
+				t.Errorf("got %v, want field %q and line %d", err, test.field, test.line)
+			}
+		})
+	}
+}
+
+func TestFieldName(t *testing.T) {
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{"listen", "listen"},
+		{"clients.max", "clients.max"},
+		{"stations.0.bitrate", "stations[0].bitrate"},
+		{"stations.12.playlist.3", "stations[12].playlist[3]"},
+	}
+	for _, test := range tests {
+		if got := fieldName(test.field); got != test.want {
+			t.Errorf("fieldName(%q) = %q, want %q", test.field, got, test.want)
+		}
+	}
+}
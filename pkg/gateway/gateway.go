@@ -0,0 +1,220 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gopher9527/snowcast/pkg/kit"
+	"github.com/gopher9527/snowcast/pkg/logging"
+	"github.com/gopher9527/snowcast/pkg/protocol"
+)
+
+const (
+	MetaInt     = 16000 // bytes of audio between two ICY metadata blocks
+	queueLength = 64    // chunks waiting to be written to a listener before new ones are dropped
+)
+
+// a struct to stream stations over HTTP, so a browser or a media player can tune in without snowcast_listener
+// GET /stations/<n> streams station n with the same chunks as the UDP listeners get
+type Gateway struct {
+	state *kit.State
+}
+
+var logger = logging.Logger("gateway")
+
+func New(state *kit.State) *Gateway {
+	return &Gateway{state}
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	x, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/stations/"))
+	if !strings.HasPrefix(r.URL.Path, "/stations/") || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	stations := g.state.Stations()
+	if x < 0 || x >= len(stations) {
+		http.Error(w, kit.ErrInvalidStation.Error(), http.StatusNotFound)
+		return
+	}
+	icy := r.Header.Get("Icy-MetaData") == "1"
+	w.Header().Set("Content-Type", "audio/mpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("icy-name", stations[x].Name)
+	if icy {
+		w.Header().Set("icy-metaint", strconv.Itoa(MetaInt))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// the HTTP listener is a client of the station like any other, except that its song data goes to a queue
+	// and it counts against the limit of HTTP listeners rather than that of control clients
+	conn := &streamConn{data: make(chan []byte, queueLength), remote: r.RemoteAddr}
+	client, err := g.state.AddListener(conn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer g.state.RemoveClient(client)
+	err = g.state.SetStation(x, client)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log := logger.With("client", client.ID)
+	log.Info("HTTP listener connected", "remote", r.RemoteAddr, "station", x, "icy", icy)
+
+	var out io.Writer = w
+	var metadata *icyWriter
+	if icy {
+		metadata = &icyWriter{w: w, title: client.Station().Song()}
+		out = metadata
+	}
+	flusher, _ := w.(http.Flusher)
+	w.WriteHeader(http.StatusOK)
+	for {
+		// watch all channels, do something when an event happens
+		select {
+		case <-r.Context().Done(): // the listener has gone
+			log.Info("HTTP listener disconnected", "reason", "request closed")
+			return
+		case data := <-conn.data:
+			_, err := out.Write(data)
+			if err != nil {
+				log.Info("HTTP listener disconnected", "reason", "cannot write", "err", err)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case songname := <-client.SongChan:
+			if metadata != nil {
+				metadata.title = songname // sent in the next metadata block
+			}
+		case reason := <-client.KickChan: // the station has been removed
+			log.Info("HTTP listener disconnected", "reason", reason)
+			return
+		case <-client.CloseChan: // the server is shutting down
+			log.Info("HTTP listener disconnected", "reason", "server shutting down")
+			return
+		}
+	}
+}
+
+// a struct to interleave ICY metadata with the audio, a block with the song name follows every MetaInt bytes
+type icyWriter struct {
+	w     http.ResponseWriter
+	count int    // bytes of audio since the last metadata block
+	title string // name of the song currently playing
+	sent  string // name sent in the last metadata block
+}
+
+func (i *icyWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := MetaInt - i.count
+		if n > len(p) {
+			n = len(p)
+		}
+		m, err := i.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		i.count += n
+		p = p[n:]
+		if i.count == MetaInt {
+			_, err := i.w.Write(i.block())
+			if err != nil {
+				return written, err
+			}
+			i.count = 0
+		}
+	}
+	return written, nil
+}
+
+// return the next metadata block: its length in units of 16 bytes, then StreamTitle padded with zeros
+// a block of length 0 means the song has not changed
+func (i *icyWriter) block() []byte {
+	if i.title == i.sent {
+		return []byte{0}
+	}
+	i.sent = i.title
+	// a quote would end the title early, the length of a block is at most 255 units of 16 bytes
+	title := protocol.Truncate(strings.ReplaceAll(i.title, "'", "’"), 255*16-len("StreamTitle='';"))
+	meta := fmt.Sprintf("StreamTitle='%s';", title)
+	units := (len(meta) + 15) / 16
+	block := make([]byte, 1+units*16)
+	block[0] = byte(units)
+	copy(block[1:], meta)
+	return block
+}
+
+// a struct to queue the song data a station sends to an HTTP listener
+// a listener that falls behind loses chunks rather than holding up the station
+type streamConn struct {
+	data   chan []byte
+	remote string
+}
+
+// return the number of bytes queued, 0 if the chunk was dropped, so only song data the listener gets is counted
+func (c *streamConn) Write(b []byte) (int, error) {
+	chunk := append([]byte(nil), b...) // b must not be kept after Write returns
+	select {
+	case c.data <- chunk:
+		return len(b), nil
+	default: // the queue is full, drop the chunk
+		return 0, nil
+	}
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return 0, net.ErrClosed // song data only goes out
+}
+
+func (c *streamConn) Close() error {
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return httpAddr("")
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return httpAddr(c.remote)
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// the address of an HTTP listener, shown as http://host:port in the listing of the server
+type httpAddr string
+
+func (a httpAddr) Network() string {
+	return "http"
+}
+
+func (a httpAddr) String() string {
+	return "http://" + string(a)
+}
@@ -0,0 +1,23 @@
+package gateway
+
+import "testing"
+
+// a chunk dropped because the queue is full is not counted as written
+func TestStreamConnDrops(t *testing.T) {
+	conn := &streamConn{data: make(chan []byte, 2)}
+	chunk := make([]byte, 1400)
+	for i, want := range []int{1400, 1400, 0, 0} {
+		n, err := conn.Write(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("write %d: got %d bytes, want %d", i, n, want)
+		}
+	}
+	<-conn.data
+	n, _ := conn.Write(chunk)
+	if n != len(chunk) {
+		t.Errorf("got %d bytes once the listener took a chunk, want %d", n, len(chunk))
+	}
+}
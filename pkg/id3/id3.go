@@ -0,0 +1,311 @@
+package id3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	headerSize        = 10      // size of an ID3v2 header or footer
+	v1Size            = 128     // size of an ID3v1 tag at the end of a file
+	maxTextFrame      = 4096    // larger title, artist and album frames are skipped
+	maxUnsynchronised = 1 << 20 // bytes read at most of an ID3v2 tag that has to be unsynchronised as a whole
+)
+
+var ErrNoTag = errors.New("no ID3 tag")
+
+// a struct to represent the metadata of a song
+type Tag struct {
+	Title  string
+	Artist string
+	Album  string
+}
+
+// return "Artist – Title", just the title if there is no artist, or an empty string if there is no title
+func (t Tag) String() string {
+	if t.Title == "" {
+		return ""
+	}
+	if t.Artist == "" {
+		return t.Title
+	}
+	return t.Artist + " – " + t.Title
+}
+
+// read the ID3v2 tag at the beginning of a file and the ID3v1 tag at its end
+// fields of the ID3v2 tag win, missing ones are taken from the ID3v1 tag
+func ReadFile(path string) (Tag, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Tag{}, err
+	}
+	defer file.Close()
+	return Read(file)
+}
+
+func Read(r io.ReadSeeker) (Tag, error) {
+	v2, err2 := ReadV2(r)
+	if err2 != nil && err2 != ErrNoTag {
+		return Tag{}, err2
+	}
+	v1, err1 := ReadV1(r)
+	if err1 != nil && err1 != ErrNoTag {
+		return Tag{}, err1
+	}
+	if err2 == ErrNoTag && err1 == ErrNoTag {
+		return Tag{}, ErrNoTag
+	}
+	if v2.Title == "" {
+		v2.Title = v1.Title
+	}
+	if v2.Artist == "" {
+		v2.Artist = v1.Artist
+	}
+	if v2.Album == "" {
+		v2.Album = v1.Album
+	}
+	return v2, nil
+}
+
+// return the range of bytes between the ID3v2 tag at the beginning and the ID3v1 tag at the end
+// it is the whole file if there is no tag
+func Locate(r io.ReadSeeker) (start int64, end int64, err error) {
+	end, err = r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+	buf := make([]byte, headerSize)
+	if end >= headerSize {
+		_, err = r.Seek(0, io.SeekStart)
+		if err != nil {
+			return 0, 0, err
+		}
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return 0, 0, err
+		}
+		if bytes.Equal(buf[:3], []byte("ID3")) {
+			start = headerSize + int64(syncsafe(buf[6:10]))
+			if buf[5]&0x10 != 0 { // ID3v2.4 footer
+				start += headerSize
+			}
+		}
+	}
+	if end-start >= v1Size {
+		_, err = r.Seek(end-v1Size, io.SeekStart)
+		if err != nil {
+			return 0, 0, err
+		}
+		_, err = io.ReadFull(r, buf[:3])
+		if err != nil {
+			return 0, 0, err
+		}
+		if bytes.Equal(buf[:3], []byte("TAG")) {
+			end -= v1Size
+		}
+	}
+	if start > end { // a tag claiming to be larger than the file
+		start = end
+	}
+	return start, end, nil
+}
+
+// read the ID3v1 tag in the last 128 bytes
+func ReadV1(r io.ReadSeeker) (Tag, error) {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return Tag{}, err
+	}
+	if end < v1Size {
+		return Tag{}, ErrNoTag
+	}
+	buf := make([]byte, v1Size)
+	_, err = r.Seek(end-v1Size, io.SeekStart)
+	if err != nil {
+		return Tag{}, err
+	}
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return Tag{}, err
+	}
+	if !bytes.Equal(buf[:3], []byte("TAG")) {
+		return Tag{}, ErrNoTag
+	}
+	return Tag{
+		Title:  latin1(buf[3:33]),
+		Artist: latin1(buf[33:63]),
+		Album:  latin1(buf[63:93]),
+	}, nil
+}
+
+// read the text frames of the ID3v2 tag at the beginning
+// frames are read one at a time and the others are skipped, so a tag with large pictures is not read into memory
+func ReadV2(r io.ReadSeeker) (Tag, error) {
+	_, err := r.Seek(0, io.SeekStart)
+	if err != nil {
+		return Tag{}, err
+	}
+	header := make([]byte, headerSize)
+	_, err = io.ReadFull(r, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return Tag{}, ErrNoTag
+	} else if err != nil {
+		return Tag{}, err
+	}
+	if !bytes.Equal(header[:3], []byte("ID3")) {
+		return Tag{}, ErrNoTag
+	}
+	version := header[3]
+	flags := header[5]
+	remaining := int64(syncsafe(header[6:10])) // bytes of the tag after the header
+	if flags&0x80 != 0 && version < 4 {
+		// the whole tag is unsynchronised, so frames cannot be skipped before it is undone
+		// only its beginning is read, where the text frames usually are
+		body := make([]byte, min(remaining, maxUnsynchronised))
+		_, err = io.ReadFull(r, body)
+		if err != nil {
+			return Tag{}, err
+		}
+		body = bytes.ReplaceAll(body, []byte{0xFF, 0x00}, []byte{0xFF})
+		r, remaining = bytes.NewReader(body), int64(len(body))
+	}
+	if flags&0x40 != 0 && remaining >= 4 { // skip the extended header
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return Tag{}, err
+		}
+		var size int64
+		if version >= 4 {
+			size = int64(syncsafe(buf)) - 4 // includes its own size field
+		} else {
+			size = int64(binary.BigEndian.Uint32(buf))
+		}
+		if size < 0 || size > remaining-4 {
+			return Tag{}, errors.New("invalid ID3v2 extended header")
+		}
+		_, err = r.Seek(size, io.SeekCurrent)
+		if err != nil {
+			return Tag{}, err
+		}
+		remaining -= 4 + size
+	}
+
+	// frame ids of ID3v2.2 are 3 bytes long, later versions use 4 bytes
+	ids := map[string]*string{}
+	var tag Tag
+	idSize, sizeSize, flagsSize := 4, 4, 2
+	if version == 2 {
+		idSize, sizeSize, flagsSize = 3, 3, 0
+		ids["TT2"], ids["TP1"], ids["TAL"] = &tag.Title, &tag.Artist, &tag.Album
+	} else {
+		ids["TIT2"], ids["TPE1"], ids["TALB"] = &tag.Title, &tag.Artist, &tag.Album
+	}
+	frameHeader := make([]byte, idSize+sizeSize+flagsSize)
+	for remaining >= int64(len(frameHeader)) && len(ids) > 0 {
+		_, err = io.ReadFull(r, frameHeader)
+		if err != nil {
+			break // a truncated file, keep what has been read so far
+		}
+		remaining -= int64(len(frameHeader))
+		if frameHeader[0] == 0 {
+			break // the rest is padding
+		}
+		id := string(frameHeader[:idSize])
+		var size int64
+		switch {
+		case version == 2:
+			size = int64(frameHeader[3])<<16 | int64(frameHeader[4])<<8 | int64(frameHeader[5])
+		case version >= 4:
+			size = int64(syncsafe(frameHeader[4:8]))
+		default:
+			size = int64(binary.BigEndian.Uint32(frameHeader[4:8]))
+		}
+		if size > remaining {
+			break // a broken frame, keep what has been read so far
+		}
+		remaining -= size
+		field, ok := ids[id]
+		if !ok || size > maxTextFrame {
+			// skip pictures and other frames without reading them
+			_, err = r.Seek(size, io.SeekCurrent)
+			if err != nil {
+				return Tag{}, err
+			}
+			continue
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			break
+		}
+		*field = text(data)
+		if *field != "" {
+			delete(ids, id) // only the first frame with an id and some text counts
+		}
+	}
+	return tag, nil
+}
+
+// return the size stored in 4 bytes of 7 bits each
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7F)<<21 | int(b[1]&0x7F)<<14 | int(b[2]&0x7F)<<7 | int(b[3]&0x7F)
+}
+
+// decode a text frame, whose first byte gives the encoding
+func text(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	var s string
+	switch b[0] {
+	case 0: // ISO-8859-1
+		s = latin1(b[1:])
+	case 1: // UTF-16 with a byte order mark
+		s = utf16String(b[1:], true)
+	case 2: // UTF-16BE without a byte order mark
+		s = utf16String(b[1:], false)
+	default: // UTF-8
+		s = string(b[1:])
+	}
+	// only keep the first of several null-separated strings
+	if i := strings.IndexByte(s, 0); i != -1 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+func latin1(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i != -1 {
+		b = b[:i]
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c) // ISO-8859-1 maps directly to the first 256 code points
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+func utf16String(b []byte, bom bool) string {
+	var order binary.ByteOrder = binary.BigEndian
+	if bom && len(b) >= 2 {
+		if b[0] == 0xFF && b[1] == 0xFE {
+			order = binary.LittleEndian
+		}
+		b = b[2:]
+	}
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		unit := order.Uint16(b[i:])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+	return string(utf16.Decode(units))
+}
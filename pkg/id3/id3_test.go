@@ -0,0 +1,229 @@
+package id3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// return a frame of an ID3v2 tag of the given version
+func v2Frame(version byte, id string, data []byte) []byte {
+	var b []byte
+	switch version {
+	case 2:
+		b = append([]byte(id), byte(len(data)>>16), byte(len(data)>>8), byte(len(data)))
+	case 3:
+		b = binary.BigEndian.AppendUint32([]byte(id), uint32(len(data)))
+		b = append(b, 0, 0)
+	default:
+		b = append([]byte(id), syncsafeBytes(len(data))...)
+		b = append(b, 0, 0)
+	}
+	return append(b, data...)
+}
+
+// return an ID3v2 tag of the given version and flags holding the frames
+func v2Tag(version byte, flags byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	b := append([]byte{'I', 'D', '3', version, 0, flags}, syncsafeBytes(len(body))...)
+	return append(b, body...)
+}
+
+// return an ID3v1 tag
+func v1Tag(title, artist, album string) []byte {
+	b := make([]byte, v1Size)
+	copy(b, "TAG")
+	copy(b[3:33], title)
+	copy(b[33:63], artist)
+	copy(b[63:93], album)
+	return b
+}
+
+func syncsafeBytes(n int) []byte {
+	return []byte{byte(n>>21) & 0x7F, byte(n>>14) & 0x7F, byte(n>>7) & 0x7F, byte(n) & 0x7F}
+}
+
+// text frames in each of the four encodings
+func latin1Text(s string) []byte {
+	b := []byte{0}
+	for _, r := range s {
+		b = append(b, byte(r))
+	}
+	return b
+}
+
+func utf8Text(s string) []byte {
+	return append([]byte{3}, s...)
+}
+
+func utf16Text(s string, bom bool) []byte {
+	b := []byte{2}
+	var order binary.AppendByteOrder = binary.BigEndian
+	if bom {
+		b = []byte{1, 0xFF, 0xFE}
+		order = binary.LittleEndian
+	}
+	for _, r := range s {
+		b = order.AppendUint16(b, uint16(r))
+	}
+	return append(b, 0, 0)
+}
+
+func TestTagString(t *testing.T) {
+	tests := []struct {
+		tag  Tag
+		want string
+	}{
+		{Tag{Title: "Impact", Artist: "FX", Album: "Sounds"}, "FX – Impact"},
+		{Tag{Title: "Impact"}, "Impact"},
+		{Tag{Artist: "FX", Album: "Sounds"}, ""},
+		{Tag{}, ""},
+	}
+	for _, test := range tests {
+		if got := test.tag.String(); got != test.want {
+			t.Errorf("%+v: got %q, want %q", test.tag, got, test.want)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	audio := bytes.Repeat([]byte{0xFF, 0xFB, 0x90, 0x00}, 64)
+	picture := v2Frame(3, "APIC", make([]byte, 300)) // larger than 127 bytes, so a size that is not syncsafe shows
+	tests := []struct {
+		name string
+		file []byte
+		want Tag
+	}{
+		{"ID3v2.3", append(v2Tag(3, 0,
+			v2Frame(3, "TIT2", latin1Text("Impact")),
+			v2Frame(3, "TPE1", latin1Text("FX")),
+			v2Frame(3, "TALB", latin1Text("Sounds"))), audio...),
+			Tag{"Impact", "FX", "Sounds"}},
+		{"ID3v2.4", append(v2Tag(4, 0,
+			v2Frame(4, "APIC", make([]byte, 300)),
+			v2Frame(4, "TIT2", utf8Text("Café")),
+			v2Frame(4, "TPE1", utf8Text("Zoë"))), audio...),
+			Tag{Title: "Café", Artist: "Zoë"}},
+		{"ID3v2.2", append(v2Tag(2, 0,
+			v2Frame(2, "TT2", latin1Text("Impact")),
+			v2Frame(2, "TP1", latin1Text("FX")),
+			v2Frame(2, "TAL", latin1Text("Sounds"))), audio...),
+			Tag{"Impact", "FX", "Sounds"}},
+		{"ISO-8859-1", v2Tag(3, 0, v2Frame(3, "TIT2", latin1Text("Déjà vu"))), Tag{Title: "Déjà vu"}},
+		{"UTF-16 with BOM", v2Tag(3, 0, v2Frame(3, "TIT2", utf16Text("Über", true))), Tag{Title: "Über"}},
+		{"UTF-16BE", v2Tag(4, 0, v2Frame(4, "TIT2", utf16Text("Über", false))), Tag{Title: "Über"}},
+		{"picture first", v2Tag(3, 0, picture, v2Frame(3, "TIT2", latin1Text("Impact"))), Tag{Title: "Impact"}},
+		{"several strings", v2Tag(4, 0, v2Frame(4, "TPE1", utf8Text("FX\x00Other"))), Tag{Artist: "FX"}},
+		{"spaces", v2Tag(3, 0, v2Frame(3, "TIT2", latin1Text("  Impact  "))), Tag{Title: "Impact"}},
+		{"empty frame first", v2Tag(3, 0,
+			v2Frame(3, "TIT2", latin1Text("")),
+			v2Frame(3, "TIT2", latin1Text("Impact")),
+			v2Frame(3, "TIT2", latin1Text("Other"))),
+			Tag{Title: "Impact"}},
+		{"padding", append(v2Tag(3, 0, v2Frame(3, "TIT2", latin1Text("Impact")), make([]byte, 100)), audio...), Tag{Title: "Impact"}},
+		{"broken frame", v2Tag(3, 0,
+			v2Frame(3, "TIT2", latin1Text("Impact")),
+			binary.BigEndian.AppendUint32([]byte("TPE1"), 1000)),
+			Tag{Title: "Impact"}},
+		{"ID3v1", append(audio, v1Tag("Impact", "FX", "Sounds")...), Tag{"Impact", "FX", "Sounds"}},
+		{"ID3v1 fills missing fields", bytes.Join([][]byte{
+			v2Tag(3, 0, v2Frame(3, "TIT2", latin1Text("Long title of the ID3v2 tag"))),
+			audio,
+			v1Tag("Long title of the ID3v1", "FX", "Sounds")}, nil),
+			Tag{"Long title of the ID3v2 tag", "FX", "Sounds"}},
+		{"no title", v2Tag(3, 0, v2Frame(3, "TPE1", latin1Text("FX"))), Tag{Artist: "FX"}},
+		{"no frames", append(v2Tag(3, 0), audio...), Tag{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tag, err := Read(bytes.NewReader(test.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tag != test.want {
+				t.Errorf("got %+v, want %+v", tag, test.want)
+			}
+		})
+	}
+}
+
+func TestReadNoTag(t *testing.T) {
+	for _, file := range [][]byte{nil, []byte("ID3"), bytes.Repeat([]byte{0xFF, 0xFB, 0x90, 0x00}, 64)} {
+		_, err := Read(bytes.NewReader(file))
+		if err != ErrNoTag {
+			t.Errorf("%d bytes: got %v, want ErrNoTag", len(file), err)
+		}
+	}
+}
+
+// an unsynchronised tag has a 0x00 after each 0xFF, which is removed before the frames are read
+func TestReadUnsynchronised(t *testing.T) {
+	title := latin1Text("ÿImpact") // ÿ is 0xFF in ISO-8859-1
+	unsynchronised := bytes.ReplaceAll(v2Frame(3, "TIT2", title), []byte{0xFF}, []byte{0xFF, 0x00})
+	file := v2Tag(3, 0x80, unsynchronised, v2Frame(3, "TPE1", latin1Text("FX")))
+	tag, err := Read(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Tag{Title: "ÿImpact", Artist: "FX"}
+	if tag != want {
+		t.Errorf("got %+v, want %+v", tag, want)
+	}
+}
+
+func TestReadExtendedHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  byte
+		extended []byte
+	}{
+		{"ID3v2.3", 3, append(binary.BigEndian.AppendUint32(nil, 6), make([]byte, 6)...)}, // the size excludes itself
+		{"ID3v2.4", 4, append(syncsafeBytes(6), 1, 0)},                                    // the size includes itself
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := v2Tag(test.version, 0x40, test.extended, v2Frame(test.version, "TIT2", latin1Text("Impact")))
+			tag, err := Read(bytes.NewReader(file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tag.Title != "Impact" {
+				t.Errorf("got %+v", tag)
+			}
+		})
+	}
+}
+
+// a reader that counts the bytes read
+type countingReader struct {
+	io.ReadSeeker
+	read int
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(b)
+	r.read += n
+	return n, err
+}
+
+// frames that are not wanted or too large are skipped without reading them, so a tag with a large picture is cheap
+func TestReadSkipsLargeFrames(t *testing.T) {
+	file := v2Tag(4, 0,
+		v2Frame(4, "APIC", make([]byte, 1<<20)),
+		v2Frame(4, "TIT2", utf8Text(string(bytes.Repeat([]byte("a"), maxTextFrame)))),
+		v2Frame(4, "TIT2", utf8Text("Impact")),
+		v2Frame(4, "TPE1", utf8Text("FX")))
+	r := &countingReader{ReadSeeker: bytes.NewReader(file)}
+	tag, err := ReadV2(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Tag{Title: "Impact", Artist: "FX"}
+	if tag != want {
+		t.Errorf("got %+v, want %+v", tag, want)
+	}
+	if r.read > 1024 {
+		t.Errorf("read %d bytes of a tag of %d bytes", r.read, len(file))
+	}
+}
@@ -0,0 +1,47 @@
+package id3
+
+import (
+	"bytes"
+	"testing"
+)
+
+// the audio between the tags is found, so the tags are not streamed as song data
+func TestLocate(t *testing.T) {
+	audio := bytes.Repeat([]byte{0xFF, 0xFB, 0x90, 0x00}, 64)
+	v2 := v2Tag(4, 0, v2Frame(4, "TIT2", utf8Text("Impact")), make([]byte, 200))
+	footer := v2Tag(4, 0x10, v2Frame(4, "TIT2", utf8Text("Impact")))
+	footer = append(footer, "3DI"...)
+	footer = append(footer, footer[3:headerSize]...)
+	v1 := v1Tag("Impact", "FX", "Sounds")
+	inside := v2Tag(3, 0, v2Frame(3, "TIT2", latin1Text("Impact")), v1) // a TAG at the end of the file that belongs to the ID3v2 tag
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	tests := []struct {
+		name       string
+		file       []byte
+		start, end int64
+	}{
+		{"no tags", audio, 0, int64(len(audio))},
+		{"empty", nil, 0, 0},
+		{"ID3v2", join(v2, audio), int64(len(v2)), int64(len(v2) + len(audio))},
+		{"ID3v2.4 footer", join(footer, audio), int64(len(footer)), int64(len(footer) + len(audio))},
+		{"ID3v1", join(audio, v1), 0, int64(len(audio))},
+		{"both", join(v2, audio, v1), int64(len(v2)), int64(len(v2) + len(audio))},
+		{"only tags", join(v2, v1), int64(len(v2)), int64(len(v2))},
+		{"ID3v1 inside the ID3v2 tag", inside, int64(len(inside)), int64(len(inside))},
+		{"ID3v2 larger than the file", join(v2[:headerSize], audio[:20]), 30, 30},
+		{"shorter than a header", []byte("ID3"), 0, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, end, err := Locate(bytes.NewReader(test.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if start != test.start || end != test.end {
+				t.Errorf("got %d to %d, want %d to %d", start, end, test.start, test.end)
+			}
+		})
+	}
+}
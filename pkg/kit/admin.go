@@ -0,0 +1,118 @@
+package kit
+
+import (
+	"errors"
+)
+
+var (
+	ErrNoSuchClient  = errors.New("no such client")
+	ErrDuplicateName = errors.New("a station with this name already exists")
+	ErrLastStation   = errors.New("the last station cannot be removed")
+	ErrNotListening  = errors.New("the client does not listen to a station")
+)
+
+// return a snapshot of all connected clients
+func (s *State) Clients() []*Client {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+	return append([]*Client(nil), s.clients...)
+}
+
+// return the connected client with an ID
+func (s *State) FindClient(id uint64) (*Client, error) {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+	for _, client := range s.clients {
+		if client.ID == id {
+			return client, nil
+		}
+	}
+	return nil, ErrNoSuchClient
+}
+
+// close the connection of a client, telling it why
+func (s *State) Kick(id uint64, reason string) error {
+	client, err := s.FindClient(id)
+	if err != nil {
+		return err
+	}
+	select {
+	case client.KickChan <- reason:
+	default: // the client is already being closed
+	}
+	return nil
+}
+
+// move a client to another station, tell a client that asked for multicast the group of the station and announce what it is playing
+// a client that has not asked for a station or has left its station is not moved, it does not expect song data
+func (s *State) Move(id uint64, x int) error {
+	client, err := s.FindClient(id)
+	if err != nil {
+		return err
+	}
+	// hold the station list until the client is a listener, as SetStation does
+	s.stationsMutex.RLock()
+	defer s.stationsMutex.RUnlock()
+	if x < 0 || x >= len(s.stations) {
+		return ErrInvalidStation
+	}
+	if !s.relocate(client, s.stations[x]) {
+		return ErrNotListening
+	}
+	return nil
+}
+
+// end the song a station is playing, the next one of its playlist starts right away
+func (s *State) Skip(x int) error {
+	s.stationsMutex.RLock()
+	defer s.stationsMutex.RUnlock()
+	if x < 0 || x >= len(s.stations) {
+		return ErrInvalidStation
+	}
+	select {
+	case s.stations[x].skip <- 1:
+	default: // a skip is already waiting
+	}
+	return nil
+}
+
+// add a station after the existing ones, it starts streaming right away
+func (s *State) AddStation(def StationDef) error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	defs := append(s.defs(), def)
+	err := checkNames(defs)
+	if err != nil {
+		return err
+	}
+	s.reload(defs)
+	return nil
+}
+
+// remove a station, its listeners are moved to the first station that is left
+// the stations after it are renumbered
+func (s *State) RemoveStation(x int) error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	defs := s.defs()
+	if x < 0 || x >= len(defs) {
+		return ErrInvalidStation
+	}
+	if len(defs) == 1 {
+		return ErrLastStation
+	}
+	s.reload(append(defs[:x], defs[x+1:]...))
+	return nil
+}
+
+// return the definitions of the current stations
+func (s *State) defs() []StationDef {
+	stations := s.Stations()
+	defs := make([]StationDef, len(stations))
+	for i, station := range stations {
+		station.mutex.Lock()
+		defs[i] = StationDef{Name: station.Name, Playlist: station.Playlist, ByteRate: station.ByteRate, Group: station.Group}
+		station.mutex.Unlock()
+	}
+	return defs
+}
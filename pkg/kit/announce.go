@@ -0,0 +1,121 @@
+package kit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// a struct to describe how announcements reach clients that fall behind
+// a station never waits for a client: an announcement that finds the previous one still queued replaces it,
+// since only the song playing now matters, and a client that leaves announcements queued too long is kicked
+type Delivery struct {
+	WriteTimeout time.Duration // how long a write to a control connection may block, 0 means no limit
+	MaxPending   time.Duration // how long an announcement may wait for the client to take it before it is kicked, 0 means no limit
+}
+
+// give up on a write after 5 seconds and kick a client that has not taken an announcement for 10 seconds, unless told otherwise
+var DefaultDelivery = Delivery{WriteTimeout: 5 * time.Second, MaxPending: 10 * time.Second}
+
+// change how announcements are delivered, call it before the stations start
+func (s *State) SetDelivery(delivery Delivery) {
+	s.delivery = delivery
+}
+
+// queue the name of a song for a client without blocking, replacing an announcement the client has not taken yet
+// the queue holds one announcement, since only the song playing now matters to a client
+func (s *State) announce(client *Client, songname string) {
+	select {
+	case client.SongChan <- songname:
+		client.pendingSince.Store(time.Now().UnixNano()) // the client has taken every announcement before this one
+		return
+	default:
+	}
+	if s.tooSlow(client) {
+		return
+	}
+	select {
+	case <-client.SongChan: // the client has not taken the previous announcement, drop it
+		s.coalesced.Add(1)
+	default: // the client has just taken it
+		client.pendingSince.Store(time.Now().UnixNano())
+	}
+	select {
+	case client.SongChan <- songname:
+	default: // another goroutine has queued an announcement in the meantime
+		s.coalesced.Add(1)
+	}
+}
+
+// kick a client that has left an announcement queued for longer than MaxPending, return true if it is kicked
+func (s *State) tooSlow(client *Client) bool {
+	since := client.pendingSince.Load()
+	if s.delivery.MaxPending <= 0 || since == 0 {
+		return false
+	}
+	pending := time.Since(time.Unix(0, since))
+	if pending <= s.delivery.MaxPending {
+		return false
+	}
+	select {
+	case client.KickChan <- "too slow to take announcements":
+		s.slow.Add(1)
+		logger.Warn("slow client kicked", "client", client.ID, "pending", pending.String())
+	default: // the client is already being closed
+	}
+	return true
+}
+
+// return the number of announcements dropped because a newer one replaced them
+func (s *State) Coalesced() uint64 {
+	return s.coalesced.Load()
+}
+
+// return the number of clients kicked because they did not take announcements
+func (s *State) SlowKicked() uint64 {
+	return s.slow.Load()
+}
+
+// return a connection whose writes fail after a timeout, so a connection goroutine stuck on a client that does
+// not read gets an error instead of blocking forever, a write deadline set on the connection still applies if it is earlier
+func WithWriteTimeout(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+	return &timeoutConn{Conn: conn, timeout: timeout}
+}
+
+type timeoutConn struct {
+	net.Conn
+	timeout  time.Duration
+	mutex    sync.Mutex
+	deadline time.Time // set by SetWriteDeadline or SetDeadline, zero if none
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	deadline := time.Now().Add(c.timeout)
+	if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+		deadline = c.deadline
+	}
+	c.mutex.Unlock()
+	err := c.Conn.SetWriteDeadline(deadline)
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *timeoutConn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.deadline = t
+	c.mutex.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *timeoutConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.deadline = t
+	c.mutex.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
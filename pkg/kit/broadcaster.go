@@ -0,0 +1,46 @@
+package kit
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// a struct to own the listeners of a station
+// the station goroutine sends to a snapshot of the listeners without locking, while connection goroutines add and
+// remove listeners by publishing a new copy of the list, so a snapshot is never changed once it has been published
+type broadcaster struct {
+	listeners atomic.Pointer[[]*Client] // the current snapshot, nil means no listener
+	mutex     sync.Mutex                // ensure only one goroutine copies the list at a time, so no change is lost
+}
+
+// return the current listeners, the slice must not be modified
+func (b *broadcaster) snapshot() []*Client {
+	listeners := b.listeners.Load()
+	if listeners == nil {
+		return nil
+	}
+	return *listeners
+}
+
+func (b *broadcaster) add(client *Client) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	old := b.snapshot()
+	listeners := make([]*Client, len(old), len(old)+1)
+	copy(listeners, old)
+	listeners = append(listeners, client)
+	b.listeners.Store(&listeners)
+}
+
+func (b *broadcaster) remove(client *Client) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	old := b.snapshot()
+	listeners := make([]*Client, 0, len(old))
+	for _, c := range old {
+		if c != client {
+			listeners = append(listeners, c)
+		}
+	}
+	b.listeners.Store(&listeners)
+}
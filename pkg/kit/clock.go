@@ -0,0 +1,64 @@
+package kit
+
+import "time"
+
+// how far a station may fall behind its timeline before it skips song data instead of sending it faster
+// a station that skips drops song data until it is back on its timeline
+const maxLag = time.Second
+
+// a struct to pace a station on a timeline that starts when the station starts
+// a chunk of song data is due when the song data before it has played since the start, so the deadlines are
+// absolute and a chunk that is sent late does not push the chunks after it back
+type clock struct {
+	start    time.Time        // when the station started, it has a monotonic reading
+	position time.Duration    // playing time of the song data sent or skipped so far, the due time of the next chunk
+	skipping bool             // the station fell more than maxLag behind and has not caught up yet
+	now      func() time.Time // time.Now, tests replace it to drive the clock
+}
+
+func newClock() *clock {
+	return &clock{start: time.Now(), now: time.Now}
+}
+
+// return when the next chunk of song data is due
+func (c *clock) deadline() time.Time {
+	return c.start.Add(c.position)
+}
+
+// return how far the station is behind its timeline, a negative lag means the next chunk is not due yet
+func (c *clock) lag() time.Duration {
+	return c.now().Sub(c.deadline())
+}
+
+// return true if the next chunk of song data, which plays for a duration, should be dropped rather than sent
+// a station up to maxLag behind catches up by sending without waiting, one further behind, e.g. after a stall,
+// drops every chunk that should have finished playing by now, so its listeners hear what is due now
+func (c *clock) skip(duration time.Duration) bool {
+	lag := c.lag()
+	if lag > maxLag {
+		c.skipping = true
+	} else if lag < duration {
+		c.skipping = false // the chunk is still playing on the timeline, the station is back on it
+	}
+	return c.skipping
+}
+
+// move on to the next chunk of song data, which plays for a duration
+func (c *clock) advance(duration time.Duration) {
+	c.position += duration
+}
+
+// wait until the next chunk of song data is due or the station is stopped
+// a station that is behind does not wait, so it catches up by sending the chunks it owes at once
+func (c *clock) wait(stop <-chan int) {
+	wait := c.deadline().Sub(c.now())
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-stop:
+	}
+}
@@ -0,0 +1,91 @@
+package kit
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// a station paced by a clock sends chunks on time, catches up when it is up to maxLag behind
+// and skips what should have played by now when it is further behind
+// each chunk plays for 100ms and the station stalls before some of them,
+// a chunk is sent on time (s), sent late while catching up (c) or skipped (x)
+func TestClockPacing(t *testing.T) {
+	const duration = 100 * time.Millisecond
+	tests := []struct {
+		name   string
+		stalls map[int]time.Duration // how long the station stalls before sending a chunk
+		want   string
+	}{
+		{"on time", nil, "ssssss"},
+		{"short stall", map[int]time.Duration{1: 30 * time.Millisecond}, "scssss"},
+		{"catch up", map[int]time.Duration{1: 500 * time.Millisecond}, "sccccc" + "ssss"},
+		{"stall of maxLag", map[int]time.Duration{1: maxLag}, "s" + strings.Repeat("c", 10) + "ssss"},
+		{"stall beyond maxLag", map[int]time.Duration{1: 1500 * time.Millisecond}, "s" + strings.Repeat("x", 15) + "ssss"},
+		{"skip until a chunk is playing", map[int]time.Duration{1: 1550 * time.Millisecond}, "s" + strings.Repeat("x", 15) + "cssss"},
+		{"stall while catching up", map[int]time.Duration{1: 600 * time.Millisecond, 2: 600 * time.Millisecond},
+			"sc" + strings.Repeat("x", 11) + "ssss"},
+		{"two stalls beyond maxLag", map[int]time.Duration{1: 1500 * time.Millisecond, 20: 1200 * time.Millisecond},
+			"s" + strings.Repeat("x", 15) + "ssss" + strings.Repeat("x", 12) + "ss"},
+	}
+	stopped := make(chan int)
+	close(stopped) // the fake time moves on to the deadline instead of waiting for it
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Now()
+			c := &clock{start: now, now: func() time.Time { return now }}
+			var got strings.Builder
+			for i := range test.want {
+				now = now.Add(test.stalls[i])
+				switch {
+				case c.skip(duration):
+					got.WriteByte('x')
+				case c.lag() > 0:
+					got.WriteByte('c')
+				default:
+					got.WriteByte('s')
+				}
+				c.advance(duration)
+				c.wait(stopped)
+				if now.Before(c.deadline()) {
+					now = c.deadline()
+				}
+			}
+			if got.String() != test.want {
+				t.Errorf("got %s, want %s", got.String(), test.want)
+			}
+			if c.skipping {
+				t.Error("the station is still skipping")
+			}
+		})
+	}
+}
+
+// a clock waits for a chunk that is not due yet, until it is due or the station is stopped,
+// and not at all for a chunk that is due or late
+func TestClockWait(t *testing.T) {
+	tests := []struct {
+		name  string
+		lag   time.Duration
+		waits bool
+	}{
+		{"due", 0, false},
+		{"late", 500 * time.Millisecond, false},
+		{"far behind", time.Hour, false},
+		{"early", -time.Hour, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Now()
+			c := &clock{start: start, now: func() time.Time { return start.Add(test.lag) }}
+			stop := make(chan int)
+			timer := time.AfterFunc(50*time.Millisecond, func() { close(stop) })
+			defer timer.Stop()
+			c.wait(stop)
+			waited := time.Since(start) >= 50*time.Millisecond
+			if waited != test.waits {
+				t.Errorf("waited %v, want a wait: %v", time.Since(start), test.waits)
+			}
+		})
+	}
+}
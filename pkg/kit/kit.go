@@ -2,115 +2,509 @@ package kit
 
 import (
 	"bufio"
-	"fmt"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/gopher9527/snowcast/pkg/logging"
+	"github.com/gopher9527/snowcast/pkg/metrics"
+	"github.com/gopher9527/snowcast/pkg/protocol"
 )
 
 // a struct to represent client connections
 type Client struct {
-	Station   *Station    // current station
+	ID        uint64      // identifies the client in the admin API
+	Since     time.Time   // when the client connected
 	TcpConn   net.Conn    // for future use
-	UdpConn   net.Conn    // use for sending song data
+	UdpConn   net.Conn    // use for sending song data, nil until the listener of a client that asked for registration has registered
 	CloseChan chan int    // use for closing all client connections
 	SongChan  chan string // use for sending Announce messages
+	KickChan  chan string // use for sending an InvalidCommand message and closing the connection
+	GroupChan chan int    // use for sending a Group message with the current group, when it changed without a SetStation
+	Version   uint8       // protocol version agreed in the handshake
+	Features  uint32      // optional protocol features granted in the handshake
+	station   *Station    // current station, nil if none
+	group     string      // multicast group the client was told to listen to, empty if it gets song data on its UDP port
+	removed   bool        // the client has disconnected, it must not be added to a station again
+	mutex     sync.Mutex  // UdpConn is set by the Registrar and the station is changed by reloads and the admin API, while stations send to the client
+	sent      atomic.Uint64
+	http      bool // an HTTP listener of the gateway, it has no control connection and does not count as a control client
+	// when the announcement waiting in SongChan was queued, in nanoseconds since the epoch
+	pendingSince atomic.Int64
+}
+
+// return the current station of the client, nil if it listens to none
+func (c *Client) Station() *Station {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.station
+}
+
+// return the multicast group the client was told to listen to, empty if it gets song data on its UDP port
+func (c *Client) Group() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.group
+}
+
+// return the bytes of song data sent to the client so far
+func (c *Client) Sent() uint64 {
+	return c.sent.Load()
+}
+
+// return the address of the control connection, or an empty string if the client has none
+func (c *Client) TcpAddr() string {
+	if c.TcpConn == nil {
+		return ""
+	}
+	return c.TcpConn.RemoteAddr().String()
+}
+
+// return the connection song data is sent to, nil if the listener has not registered yet
+func (c *Client) udp() net.Conn {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.UdpConn
+}
+
+func (c *Client) setUdp(conn net.Conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.UdpConn = conn
+}
+
+// return the address song data is sent to, or "unregistered"
+func (c *Client) UdpAddr() string {
+	conn := c.udp()
+	if conn == nil {
+		return "unregistered"
+	}
+	return conn.RemoteAddr().String()
+}
+
+// a struct to describe a station before it is created
+type StationDef struct {
+	Name     string   // unique name of the station
+	Playlist []string // files played by the station in order
+	ByteRate int      // bytes of song data sent per second, 0 means the rate of each song
+	Group    string   // "host:port" of a multicast group the song data is also sent to, empty means unicast only
 }
 
 // a struct to represent stations
 type Station struct {
-	Songname  string    // name of the song currently playing
-	Listeners []*Client // all clients listening to this station
+	ID         uint16             // identifies the station in data headers, it does not change when stations are reloaded
+	Name       string             // unique name of the station
+	Songname   string             // name of the song currently playing, from its ID3 tags or its file name
+	Filename   string             // file of the song currently playing
+	Playlist   []string           // files played by this station in order
+	ByteRate   int                // configured bytes of song data sent per second, 0 means the rate of each song
+	Group      string             // "host:port" of the multicast group of the station, empty means unicast only
+	groupConn  net.Conn           // sends to the multicast group, only used by the goroutine of the station
+	dialed     string             // the group groupConn sends to
+	rate       int                // bytes per second of the song currently playing
+	lag        time.Duration      // how far the station is behind its timeline, negative if it is waiting for the next chunk
+	skipped    atomic.Int64       // playing time of the song data dropped because the station was too far behind, in nanoseconds
+	track      int                // index of the song currently playing in the playlist
+	seq        uint32             // sequence number of the next datagram
+	listeners  broadcaster        // all clients listening to this station
+	stop       chan int           // closed when the station is removed
+	skip       chan int           // receives when the song currently playing should end
+	bytesSent  atomic.Uint64      // bytes of song data sent in datagrams, to listeners and the multicast group
+	httpBytes  atomic.Uint64      // bytes of song data queued for HTTP listeners of the gateway
+	datagrams  atomic.Uint64      // datagrams sent
+	sendErrors atomic.Uint64      // datagrams that could not be sent
+	lateness   *metrics.Histogram // how much later than planned each chunk of song data was done with, in seconds
+	mutex      sync.Mutex
+}
+
+func NewStation(def StationDef) *Station {
+	filename := def.Playlist[0]
+	return &Station{Name: def.Name, Songname: filename, Filename: filename, Playlist: def.Playlist, ByteRate: def.ByteRate, Group: def.Group, stop: make(chan int), skip: make(chan int, 1), lateness: metrics.NewHistogram(latenessBuckets)}
+}
+
+// return the multicast group of the station
+func (s *Station) MulticastGroup() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Group
+}
+
+// return a connection to the multicast group, dialing it again if the group has changed
+func (s *Station) dialGroup(group string) (net.Conn, error) {
+	if s.groupConn != nil && s.dialed == group {
+		return s.groupConn, nil
+	}
+	s.closeGroup()
+	conn, err := net.Dial("udp", group)
+	if err != nil {
+		return nil, err
+	}
+	s.groupConn, s.dialed = conn, group
+	return conn, nil
+}
+
+func (s *Station) closeGroup() {
+	if s.groupConn != nil {
+		s.groupConn.Close()
+		s.groupConn, s.dialed = nil, ""
+	}
+}
+
+// move on to the next song of the playlist, starting over after the last one, and return its file
+func (s *Station) next() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.track = (s.track + 1) % len(s.Playlist)
+	s.Filename = s.Playlist[s.track]
+	return s.Filename
+}
+
+// set the name of the song that has just been opened
+func (s *Station) playing(songname string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Songname = songname
+}
+
+// return the name of the song currently playing
+func (s *Station) Song() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Songname
+}
+
+// return the file of the song currently playing
+func (s *Station) File() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Filename
+}
+
+// return the files played by the station in order
+func (s *Station) Files() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Playlist
+}
+
+// return the clients listening to the station, the slice must not be modified
+func (s *Station) Listeners() []*Client {
+	return s.listeners.snapshot()
+}
+
+// return the configured bytes of song data sent per second
+func (s *Station) byteRate() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ByteRate
 }
 
-func NewStation(name string) *Station {
-	return &Station{Songname: name}
+// return the bytes per second of the song currently playing
+func (s *Station) Rate() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rate
 }
 
+// return how far the station is behind the position it should have reached on its timeline
+// a negative lag means the station is waiting for the next chunk of song data to be due
+func (s *Station) Lag() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lag
+}
+
+// return the playing time of the song data dropped because the station was too far behind to catch up
+func (s *Station) Skipped() time.Duration {
+	return time.Duration(s.skipped.Load())
+}
+
+func (s *Station) measure(rate int, lag time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rate = rate
+	s.lag = lag
+}
+
+var logger = logging.Logger("kit")
+
+var (
+	ErrServerFull     = errors.New("server is full")
+	ErrInvalidStation = errors.New("invalid station number")
+)
+
 // a struct to represent the state of the server
 type State struct {
-	clients      []*Client      // all connected clients
-	Stations     []*Station     // all stations
-	waitGroup    sync.WaitGroup // use for waiting for all clients to be done
-	clientsMutex sync.RWMutex   // ensure only one goroutine can modify the client list at a time
+	clients       []*Client      // all connected clients
+	stations      []*Station     // all stations, the index is the station number
+	maxClients    int            // the maximum number of connected control clients, 0 means no limit
+	maxListeners  int            // the maximum number of HTTP listeners, 0 means no limit
+	controls      int            // number of connected control clients
+	listeners     int            // number of HTTP listeners
+	nextID        uint16         // ID of the next station to create
+	lastClientID  uint64         // ID of the last client to connect, IDs start at 1
+	evicted       atomic.Uint64  // number of clients removed because they stopped answering pings
+	coalesced     atomic.Uint64  // number of announcements replaced by a newer one before the client took them
+	slow          atomic.Uint64  // number of clients kicked because they left an announcement queued too long
+	delivery      Delivery       // how announcements reach clients that fall behind
+	waitGroup     sync.WaitGroup // use for waiting for all clients to be done
+	clientsMutex  sync.RWMutex   // ensure only one goroutine can modify the client list at a time
+	stationsMutex sync.RWMutex   // ensure only one goroutine can modify the station list at a time
+	reloadMutex   sync.Mutex     // ensure only one reload, addition or removal of stations happens at a time
 }
 
-func NewState(files []string) *State {
-	n := len(files)
-	stations := make([]*Station, n)
-	for i, file := range files {
-		stations[i] = NewStation(file)
+func NewState(defs []StationDef, maxClients int) *State {
+	s := &State{maxClients: maxClients, delivery: DefaultDelivery}
+	s.stations = make([]*Station, len(defs))
+	for i, def := range defs {
+		s.stations[i] = s.newStation(def)
 	}
-	return &State{Stations: stations}
+	return s
+}
+
+// create a station with a new ID
+func (s *State) newStation(def StationDef) *Station {
+	station := NewStation(def)
+	station.ID = s.nextID
+	s.nextID++
+	return station
 }
 
 func (s *State) StartStations() {
 	// start sending data from radio stations to client listener programs
-	for _, station := range s.Stations {
+	for _, station := range s.Stations() {
 		go start(station, s) // start a new goroutine to send out song data
 	}
 }
 
+// return a snapshot of all stations, the index is the station number
+func (s *State) Stations() []*Station {
+	s.stationsMutex.RLock()
+	defer s.stationsMutex.RUnlock()
+	return append([]*Station(nil), s.stations...)
+}
+
+func (s *State) NumStations() int {
+	s.stationsMutex.RLock()
+	defer s.stationsMutex.RUnlock()
+	return len(s.stations)
+}
+
 const (
-	count     = 16                // send 16 chunks per second
-	chunkSize = 16 * 1024 / count // the size of a chunk of song data
-	interval  = 1000000 / count   // send out a chunk of song data to every connected listener at every time interval
+	DefaultByteRate = 16 * 1024 // send song data at a rate of 16KiB/s unless told otherwise
+	count           = 16        // send 16 chunks per second when a song is not MPEG audio
 )
 
+// a struct to describe how clients that asked for keepalive are checked
+type Keepalive struct {
+	Interval time.Duration // time between two pings, 0 means clients are never pinged
+	Misses   int           // pings left unanswered in a row before a client is evicted
+}
+
+// ping every 5 seconds and evict a client after 3 unanswered pings, unless told otherwise
+var DefaultKeepalive = Keepalive{Interval: 5 * time.Second, Misses: 3}
+
 func start(s *Station, state *State) {
-	file, err := os.Open(s.Songname)
+	defer s.closeGroup()
+	log := logger.With("station", s.Name)
+	filename := s.File() // a reload may change the station while it starts
+	song, songname, err := openSource(filename, s.byteRate())
 	if err != nil {
-		log.Println(err)
+		log.Error("cannot open song, station stopped", "file", filename, "err", err)
 		return
 	}
-	// send song data at a rate of 16KiB/s
+	s.playing(songname)
+	log.Debug("song started", "file", filename, "song", songname)
+	clock := newClock()
+	// send song data at the rate of the song, whole frames at a time for MPEG audio
 	for {
-		data := make([]byte, chunkSize) // read a chunk from the file
-		startTime := time.Now()         // store the start time
-		n, err := file.Read(data)
-		if err != nil && err != io.EOF {
-			fmt.Println(err)
+		skipped := false
+		select {
+		case <-s.stop: // the station has been removed
+			closeSong(log, song)
+			log.Info("station stopped")
 			return
+		case <-s.skip: // end the song as if it were over
+			skipped = true
+		default:
 		}
-		if n < chunkSize || err == io.EOF { // send an Announce when a song repeats
-			file.Seek(0, io.SeekStart) // set the offset for the next Read
-			notify(s, state)           // notify
+		var data []byte
+		var duration time.Duration
+		if skipped {
+			err = io.EOF
+		} else {
+			data, duration, err = song.next()
 		}
-		send(s, state, data, n) // send out this chunk of song data to every connected listener
-		// measure the time it takes to send out the data, and subtract this from the sleep time
-		time.Sleep(interval*time.Microsecond - time.Since(startTime))
+		if err == io.EOF { // send an Announce when the next song starts
+			closeSong(log, song)
+			filename = s.next()
+			song, songname, err = openSource(filename, s.byteRate()) // open the next song of the playlist
+			if err != nil {
+				log.Error("cannot open song, station stopped", "file", filename, "err", err)
+				return
+			}
+			s.playing(songname)
+			log.Debug("song started", "file", filename, "song", songname, "skipped", skipped)
+			notify(s, state) // notify
+			continue
+		}
+		if err != nil {
+			log.Error("cannot read song, station stopped", "err", err)
+			closeSong(log, song)
+			return
+		}
+		behind := clock.skipping
+		if clock.skip(duration) {
+			if !behind {
+				log.Warn("station too far behind, skipping song data", "lag", clock.lag().String())
+			}
+			s.skipped.Add(int64(duration))
+		} else {
+			send(s, state, data, len(data), clock.position) // send out this chunk of song data to every connected listener
+		}
+		clock.advance(duration)
+		// sleep until the next chunk is due, the time spent sending is taken off the sleep, late chunks are sent at once
+		clock.wait(s.stop)
+		s.lateness.Observe(math.Max(0, clock.lag().Seconds()))
+		s.measure(song.byteRate(), clock.lag())
 	}
 }
 
-func send(s *Station, state *State, data []byte, n int) {
-	for _, client := range s.Listeners {
-		client.UdpConn.Write(data[:n]) // send out the data to listener
+func closeSong(log *slog.Logger, song source) {
+	err := song.Close()
+	if err != nil {
+		log.Warn("cannot close song", "err", err)
 	}
 }
 
+func send(s *Station, state *State, data []byte, n int, played time.Duration) {
+	header := protocol.DataHeader{StationID: s.ID, Seq: s.seq, Timestamp: uint32(played.Milliseconds())}
+	s.seq++
+	var framed []byte // the song data behind a data header, only built if a listener asked for it
+	group := s.MulticastGroup()
+	if group != "" {
+		// datagrams sent to a group always have a data header, listeners of the group may have joined at any time
+		framed = header.Prepend(data[:n])
+		conn, err := s.dialGroup(group)
+		if err != nil {
+			s.sendErrors.Add(1)
+			logger.Debug("cannot dial multicast group", "station", s.Name, "group", group, "err", err)
+		} else {
+			_, err = s.write(conn, framed)
+			if err != nil {
+				logger.Debug("cannot send to multicast group", "station", s.Name, "group", group, "err", err)
+			}
+		}
+	}
+	for _, client := range s.listeners.snapshot() {
+		if group != "" && client.Group() == group {
+			continue // the client listens to the group
+		}
+		udpConn := client.udp()
+		if udpConn == nil {
+			continue // the listener has not registered yet
+		}
+		if client.http {
+			// queued for the gateway rather than sent in a datagram, so it is not counted as UDP traffic
+			written, _ := udpConn.Write(data[:n])
+			s.httpBytes.Add(uint64(written))
+			client.sent.Add(uint64(written))
+			continue
+		}
+		if client.Features&protocol.FeatureDataHeader == 0 {
+			written, err := s.write(udpConn, data[:n]) // send out the data to listener
+			if err != nil {
+				logger.Debug("cannot send song data", "station", s.Name, "client", client.ID, "udp", udpConn.RemoteAddr().String(), "err", err)
+			} else {
+				client.sent.Add(uint64(written))
+			}
+			continue
+		}
+		if framed == nil {
+			framed = header.Prepend(data[:n])
+		}
+		written, err := s.write(udpConn, framed)
+		if err != nil {
+			logger.Debug("cannot send song data", "station", s.Name, "client", client.ID, "udp", udpConn.RemoteAddr().String(), "err", err)
+		} else {
+			client.sent.Add(uint64(written))
+		}
+	}
+}
+
+// send a datagram and count it in the metrics of the station
+func (s *Station) write(conn net.Conn, b []byte) (int, error) {
+	written, err := conn.Write(b)
+	if err != nil {
+		s.sendErrors.Add(1)
+		return written, err
+	}
+	s.datagrams.Add(1)
+	s.bytesSent.Add(uint64(written))
+	return written, nil
+}
+
+// announce the new song to every listener, a listener that does not keep up never holds the station up
 func notify(s *Station, state *State) {
-	for _, client := range s.Listeners {
-		client.SongChan <- s.Songname // send songname to channel
+	for _, client := range s.listeners.snapshot() {
+		state.announce(client, s.Song())
 	}
 }
 
-func (s *State) AddClient(tcpConn net.Conn, udpConn net.Conn) *Client {
+// add a control client, it counts against the maximum number of control clients
+func (s *State) AddClient(tcpConn net.Conn, udpConn net.Conn, version uint8, features uint32) (*Client, error) {
+	return s.addClient(tcpConn, udpConn, version, features, false)
+}
+
+// add an HTTP listener of the gateway, whose song data is written to conn
+// it counts against the maximum number of HTTP listeners rather than that of control clients
+func (s *State) AddListener(conn net.Conn) (*Client, error) {
+	return s.addClient(nil, conn, protocol.Version1, 0, true)
+}
+
+// change the maximum number of HTTP listeners, 0 means no limit, call it before the gateway starts
+func (s *State) SetMaxListeners(n int) {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	s.maxListeners = n
+}
+
+func (s *State) addClient(tcpConn net.Conn, udpConn net.Conn, version uint8, features uint32, http bool) (*Client, error) {
 	client := &Client{
-		Station:   nil,
+		Since:     time.Now(),
+		Version:   version,
+		Features:  features,
 		TcpConn:   tcpConn,
 		UdpConn:   udpConn,
 		CloseChan: make(chan int, 1),
 		SongChan:  make(chan string, 1),
+		KickChan:  make(chan string, 1),
+		GroupChan: make(chan int, 1),
+		http:      http,
 	}
-	s.waitGroup.Add(1)
 	s.clientsMutex.Lock()
+	if http && s.maxListeners > 0 && s.listeners >= s.maxListeners || !http && s.maxClients > 0 && s.controls >= s.maxClients {
+		s.clientsMutex.Unlock()
+		return nil, ErrServerFull
+	}
+	if http {
+		s.listeners++
+	} else {
+		s.controls++
+	}
+	s.waitGroup.Add(1)
+	s.lastClientID++
+	client.ID = s.lastClientID
 	s.clients = append(s.clients, client)
 	s.clientsMutex.Unlock()
-	return client
+	return client, nil
 }
 
 func (s *State) RemoveClient(client *Client) {
@@ -127,42 +521,109 @@ func (s *State) RemoveClient(client *Client) {
 		return
 	} else {
 		s.clients = append(s.clients[:index], s.clients[index+1:]...)
+		if client.http {
+			s.listeners--
+		} else {
+			s.controls--
+		}
 		s.clientsMutex.Unlock()
 	}
-	if client.Station != nil {
-		index = -1
-		for i, c := range client.Station.Listeners {
-			if c == client {
-				index = i
-				break
-			}
-		}
-		if index != -1 {
-			// remove client from listener list of subscribed station
-			client.Station.Listeners = append(client.Station.Listeners[:index], client.Station.Listeners[index+1:]...)
-		}
+	client.mutex.Lock()
+	client.removed = true
+	if client.station != nil {
+		// remove client from listener list of subscribed station
+		client.station.listeners.remove(client)
 	}
+	client.mutex.Unlock()
 	s.waitGroup.Done()
 }
 
-func (s *State) SetStation(x int, client *Client) {
-	if client.Station != nil {
-		index := -1
-		for i, c := range client.Station.Listeners {
-			if c == client {
-				index = i
-				break
-			}
-		}
-		if index != -1 {
-			// remove client from listener list of old station
-			client.Station.Listeners = append(client.Station.Listeners[:index], client.Station.Listeners[index+1:]...)
-		}
+// remove a client that stopped answering pings
+func (s *State) Evict(client *Client) {
+	s.evicted.Add(1)
+	s.RemoveClient(client)
+}
+
+// return the number of clients evicted since the server started
+func (s *State) Evicted() uint64 {
+	return s.evicted.Load()
+}
+
+func (s *State) SetStation(x int, client *Client) error {
+	// hold the station list until the client is a listener, so a reload cannot retire the station in between
+	// and leave the client on a station that no longer sends
+	s.stationsMutex.RLock()
+	defer s.stationsMutex.RUnlock()
+	if x < 0 || x >= len(s.stations) {
+		return ErrInvalidStation
 	}
-	// change station
-	client.Station = s.Stations[x]
+	station := s.stations[x]
+	// the client is told the group in the reply, from now on it gets song data from there
+	move(client, station, groupFor(client, station), false)
+	return nil
+}
+
+// return the group a client gets the song data of a station from, empty if it gets it on its UDP port
+func groupFor(client *Client, station *Station) string {
+	if client.Features&protocol.FeatureMulticast == 0 {
+		return ""
+	}
+	return station.MulticastGroup()
+}
+
+// move a client to a station it did not ask for, telling it the group of the station and the song playing
+// a client that does not listen to a station, because it has not asked for one yet or has left, is left alone,
+// since it does not expect announcements, return false if it is left alone
+func (s *State) relocate(client *Client, station *Station) bool {
+	if !move(client, station, groupFor(client, station), true) {
+		return false
+	}
+	tellGroup(client)
+	s.announce(client, station.Song())
+	return true
+}
+
+// have the connection goroutine of a client that asked for multicast send it its current group
+func tellGroup(client *Client) {
+	if client.Features&protocol.FeatureMulticast == 0 {
+		return
+	}
+	select {
+	case client.GroupChan <- 1:
+	default: // a Group message is already waiting to be sent, it reads the group when it is sent
+	}
+}
+
+// stop sending song data to a client, it stays connected
+func (s *State) Leave(client *Client) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.station != nil {
+		// remove client from listener list of its station
+		client.station.listeners.remove(client)
+		client.station = nil
+		client.group = ""
+	}
+}
+
+// move a client from its current station to another one, whose song data it gets from a multicast group if group is set
+// a client that has disconnected is left alone, and so is a client that listens to no station if listening is set
+// return false if the client is left alone
+func move(client *Client, station *Station, group string, listening bool) bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.removed || listening && client.station == nil {
+		return false
+	}
+	if client.station != nil {
+		// remove client from listener list of old station
+		client.station.listeners.remove(client)
+	}
+	client.station = station
+	client.group = group
 	// add client to listener list of new station
-	client.Station.Listeners = append(client.Station.Listeners, client)
+	station.listeners.add(client)
+	return true
 }
 
 func (s *State) Close() {
@@ -178,14 +639,19 @@ func ReadKeyboardInput(inputChan chan string) {
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		cmd, err := reader.ReadString('\n') // wait for a line of input
-		if err != nil {
-			log.Println(err)
-			continue
-		}
 		cmd = strings.Replace(cmd, "\n", "", -1)
-		if len(cmd) > 0 { // only non-empty line will be sent
+		if len(cmd) > 0 { // only non-empty line will be sent, even the last one without a newline
 			inputChan <- cmd // send to main loop
 		}
+		if err == io.EOF {
+			// stdin is closed, e.g. the program runs in the background, there will be no more input
+			logger.Debug("no more keyboard input")
+			return
+		}
+		if err != nil {
+			logger.Error("cannot read keyboard input", "err", err)
+			return
+		}
 		reader.Reset(os.Stdin)
 	}
 }
@@ -0,0 +1,387 @@
+package kit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gopher9527/snowcast/pkg/logging"
+	"github.com/gopher9527/snowcast/pkg/protocol"
+)
+
+const (
+	stressClients  = 300 // clients switching stations at once
+	stressSwitches = 50  // station switches of each client, about 20ms apart, so the stations send to the clients in between
+	stressStations = 4
+)
+
+// hundreds of clients switch stations, leave and disconnect while the stations send to them, stations are skipped
+// and reloaded, and the admin API and the metrics read the listeners, run it with -race
+func TestConcurrentStationSwitching(t *testing.T) {
+	logging.Setup(logging.Config{Output: io.Discard})
+	defer logging.Setup(logging.Config{})
+
+	dir := t.TempDir()
+	defs := make([]StationDef, stressStations)
+	for i := range defs {
+		// two chunks at the rate of the station, so songs end and are announced several times a second
+		path := filepath.Join(dir, fmt.Sprintf("song%d", i))
+		err := os.WriteFile(path, make([]byte, 2048), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defs[i] = StationDef{Name: fmt.Sprintf("station%d", i), Playlist: []string{path}, ByteRate: 16 * 1024}
+	}
+	defs[1].Group = "239.255.16.99:16999" // clients that asked for multicast are skipped by this station
+	state := NewState(defs, 0)
+	state.StartStations()
+
+	stop := make(chan int)
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		// change the stations under the clients: skip songs, add and remove a station, move listeners off it
+		defer background.Done()
+		extra := StationDef{Name: "extra", Playlist: defs[0].Playlist, ByteRate: defs[0].ByteRate}
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			state.Skip(i % stressStations)
+			if i%2 == 0 {
+				state.Reload(append(append([]StationDef(nil), defs...), extra))
+			} else {
+				state.Reload(defs)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	background.Add(1)
+	go func() {
+		// read the listeners the way the admin API, the metrics and the p command do
+		defer background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for _, station := range state.Stations() {
+				for _, client := range station.Listeners() {
+					client.Station()
+					client.Group()
+					client.UdpAddr()
+				}
+				station.Song()
+			}
+			for _, client := range state.Clients() {
+				client.Station()
+			}
+		}
+	}()
+
+	var clients, switched sync.WaitGroup
+	release := make(chan int) // closed once the stations of the clients have been checked
+	for i := 0; i < stressClients; i++ {
+		clients.Add(1)
+		switched.Add(1)
+		go func(i int) {
+			defer clients.Done()
+			features := uint32(0)
+			if i%2 == 0 {
+				features = protocol.FeatureDataHeader | protocol.FeatureMulticast
+			}
+			client, err := state.AddClient(nil, discardConn{}, protocol.Version3, features)
+			if err != nil {
+				t.Error(err)
+				switched.Done()
+				return
+			}
+			done := make(chan int)
+			go func() {
+				// read the announcements like the connection goroutine of the server does
+				for {
+					select {
+					case <-client.SongChan:
+					case <-client.KickChan:
+					case <-done:
+						return
+					}
+				}
+			}()
+			random := rand.New(rand.NewSource(int64(i)))
+			for j := 0; j < stressSwitches; j++ {
+				if random.Intn(10) == 0 {
+					state.Leave(client)
+					continue
+				}
+				err := state.SetStation(random.Intn(state.NumStations()), client)
+				if err != nil && err != ErrInvalidStation { // the extra station may be gone by now
+					t.Error(err)
+				}
+				if stranded(state, client) {
+					t.Errorf("client %d was added to station %s after it was removed", client.ID, client.Station().Name)
+				}
+				time.Sleep(time.Duration(random.Intn(40)) * time.Millisecond)
+			}
+			switched.Done()
+			<-release
+			state.RemoveClient(client)
+			close(done)
+		}(i)
+	}
+	switched.Wait()
+	close(stop)
+	background.Wait()
+
+	// a client switching while its station was removed must end up on a station that is still there, or on none
+	current := make(map[*Station]bool)
+	for _, station := range state.Stations() {
+		current[station] = true
+	}
+	for _, client := range state.Clients() {
+		if station := client.Station(); station != nil && !current[station] {
+			t.Errorf("client %d listens to station %s, which has been removed", client.ID, station.Name)
+		}
+	}
+	for _, station := range state.Stations() {
+		for _, client := range station.Listeners() {
+			if client.Station() != station {
+				t.Errorf("client %d is a listener of station %s but listens to another station", client.ID, station.Name)
+			}
+		}
+	}
+	close(release)
+	clients.Wait()
+
+	if n := len(state.Clients()); n != 0 {
+		t.Errorf("%d clients left after all of them were removed", n)
+	}
+	for _, station := range state.Stations() {
+		if n := len(station.Listeners()); n != 0 {
+			t.Errorf("station %s has %d listeners after all clients were removed", station.Name, n)
+		}
+	}
+}
+
+// check, once no reload is running, that a client does not listen to a station that has been removed
+// a reload moves the listeners off the stations it removes before it finishes
+func stranded(state *State, client *Client) bool {
+	state.reloadMutex.Lock()
+	defer state.reloadMutex.Unlock()
+	station := client.Station()
+	if station == nil {
+		return false
+	}
+	for _, s := range state.Stations() {
+		if s == station {
+			return false
+		}
+	}
+	return true
+}
+
+// stations of the same file given twice on the command line keep their listeners through a reload,
+// and definitions that use a name twice are refused
+func TestReloadDuplicateFiles(t *testing.T) {
+	logging.Setup(logging.Config{Output: io.Discard})
+	defer logging.Setup(logging.Config{})
+
+	path := filepath.Join(t.TempDir(), "song")
+	err := os.WriteFile(path, make([]byte, 2048), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := []string{path, path, path}
+	defs, err := ParseStationDefs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := NewState(defs, 0)
+	state.StartStations()
+	defer state.Reload(nil) // stop the stations
+	clients := make([]*Client, len(defs))
+	for i := range clients {
+		clients[i], err = state.AddClient(nil, discardConn{}, protocol.Version3, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer state.RemoveClient(clients[i])
+		state.SetStation(i, clients[i])
+	}
+	before := state.Stations()
+
+	// a reload that changes nothing, as after a SIGHUP
+	defs, err = ParseStationDefs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := state.Reload(defs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (ReloadResult{Unchanged: len(args)}) {
+		t.Errorf("got %s, want %d unchanged", result, len(args))
+	}
+	// definitions with the same name twice are refused
+	_, err = state.Reload([]StationDef{defs[0], defs[0]})
+	if !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("got %v, want ErrDuplicateName", err)
+	}
+
+	after := state.Stations()
+	if len(after) != len(before) {
+		t.Fatalf("%d stations after the reloads, want %d", len(after), len(before))
+	}
+	for i, station := range after {
+		if station != before[i] {
+			t.Errorf("station %d has been replaced", i)
+		}
+		select {
+		case <-station.stop:
+			t.Errorf("station %d has been stopped", i)
+		default:
+		}
+	}
+	for i, client := range clients {
+		if stranded(state, client) || client.Station() != after[i] {
+			t.Errorf("client %d does not listen to station %d any more", client.ID, i)
+		}
+	}
+}
+
+// the admin API only moves clients that listen to a station, one that has not asked for a station or has left
+// would get an announcement it does not expect
+func TestMoveClientWithoutStation(t *testing.T) {
+	logging.Setup(logging.Config{Output: io.Discard})
+	defer logging.Setup(logging.Config{})
+
+	defs := []StationDef{{Name: "a", Playlist: []string{"a.mp3"}}, {Name: "b", Playlist: []string{"b.mp3"}}}
+	state := NewState(defs, 0) // the stations are not started, so nothing but Move announces
+	client, err := state.AddClient(nil, discardConn{}, protocol.Version3, protocol.FeatureMulticast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.RemoveClient(client)
+	stations := state.Stations()
+
+	// check that the client has not been touched
+	untouched := func(when string) {
+		t.Helper()
+		err := state.Move(client.ID, 1)
+		if !errors.Is(err, ErrNotListening) {
+			t.Errorf("%s: got %v, want ErrNotListening", when, err)
+		}
+		if client.Station() != nil {
+			t.Errorf("%s: the client listens to station %s", when, client.Station().Name)
+		}
+		if n := len(stations[1].Listeners()); n != 0 {
+			t.Errorf("%s: station b has %d listeners", when, n)
+		}
+		select {
+		case song := <-client.SongChan:
+			t.Errorf("%s: the client was announced %q", when, song)
+		case <-client.GroupChan:
+			t.Errorf("%s: the client was told a group", when)
+		default:
+		}
+	}
+	untouched("before SetStation")
+
+	state.SetStation(0, client)
+	err = state.Move(client.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Station() != stations[1] {
+		t.Errorf("the client was not moved to station b")
+	}
+	select {
+	case <-client.SongChan:
+	default:
+		t.Error("the moved client was not announced the song of station b")
+	}
+	select {
+	case <-client.GroupChan:
+	default:
+		t.Error("the moved client was not told the group of station b")
+	}
+
+	state.Leave(client)
+	untouched("after Leave")
+}
+
+// a client that never takes its announcements neither holds up the station nor the other listeners, it is kicked
+func TestSlowClientDoesNotStallStation(t *testing.T) {
+	logging.Setup(logging.Config{Output: io.Discard})
+	defer logging.Setup(logging.Config{})
+
+	// a song that ends and is announced about 8 times a second
+	path := filepath.Join(t.TempDir(), "song")
+	err := os.WriteFile(path, make([]byte, 2048), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := NewState([]StationDef{{Name: "station", Playlist: []string{path}, ByteRate: 16 * 1024}}, 0)
+	defer state.Reload(nil) // stop the station
+	state.SetDelivery(Delivery{MaxPending: 300 * time.Millisecond})
+	slow, err := state.AddClient(nil, discardConn{}, protocol.Version3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, err := state.AddClient(nil, discardConn{}, protocol.Version3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.SetStation(0, slow)
+	state.SetStation(0, fast)
+	state.StartStations()
+
+	announced := 0
+	timeout := time.After(2 * time.Second)
+	for announced < 8 {
+		select {
+		case <-fast.SongChan:
+			announced++
+		case <-timeout:
+			t.Fatalf("the fast client got %d announcements while the slow one took none", announced)
+		}
+	}
+	select {
+	case reason := <-slow.KickChan:
+		if reason != "too slow to take announcements" {
+			t.Errorf("slow client kicked with %q", reason)
+		}
+	default:
+		t.Error("slow client not kicked")
+	}
+	if state.Coalesced() == 0 {
+		t.Error("no announcement of the slow client was replaced")
+	}
+	if state.SlowKicked() != 1 {
+		t.Errorf("%d clients kicked for being slow, want 1", state.SlowKicked())
+	}
+	state.RemoveClient(slow)
+	state.RemoveClient(fast)
+}
+
+// a connection that throws song data away
+type discardConn struct{}
+
+func (discardConn) Read(b []byte) (int, error)         { return 0, io.EOF }
+func (discardConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (discardConn) Close() error                       { return nil }
+func (discardConn) LocalAddr() net.Addr                { return &net.UDPAddr{} }
+func (discardConn) RemoteAddr() net.Addr               { return &net.UDPAddr{} }
+func (discardConn) SetDeadline(t time.Time) error      { return nil }
+func (discardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (discardConn) SetWriteDeadline(t time.Time) error { return nil }
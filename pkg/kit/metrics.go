@@ -0,0 +1,55 @@
+package kit
+
+import "github.com/gopher9527/snowcast/pkg/metrics"
+
+// upper bounds of the buckets of the pacing lateness histogram, in seconds
+var latenessBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// write the metrics of the clients and the stations
+func (s *State) Collect(w *metrics.Writer) {
+	s.clientsMutex.RLock()
+	controls, listeners := s.controls, s.listeners
+	s.clientsMutex.RUnlock()
+	w.Header("snowcast_control_clients", "Connected control clients.", "gauge")
+	w.Sample("snowcast_control_clients", float64(controls))
+	w.Header("snowcast_http_listeners", "Listeners connected to the HTTP gateway.", "gauge")
+	w.Sample("snowcast_http_listeners", float64(listeners))
+	w.Header("snowcast_evicted_clients_total", "Clients evicted because they stopped answering pings.", "counter")
+	w.Sample("snowcast_evicted_clients_total", float64(s.Evicted()))
+	w.Header("snowcast_announcements_coalesced_total", "Announcements replaced by a newer one before the client took them.", "counter")
+	w.Sample("snowcast_announcements_coalesced_total", float64(s.Coalesced()))
+	w.Header("snowcast_slow_clients_kicked_total", "Clients kicked because they left an announcement waiting too long.", "counter")
+	w.Sample("snowcast_slow_clients_kicked_total", float64(s.SlowKicked()))
+
+	stations := s.Stations()
+	w.Header("snowcast_station_listeners", "Clients listening to a station.", "gauge")
+	for _, station := range stations {
+		w.Sample("snowcast_station_listeners", float64(len(station.Listeners())), metrics.Label{Name: "station", Value: station.Name})
+	}
+	w.Header("snowcast_station_sent_bytes_total", "Bytes of song data sent by a station, in UDP datagrams or to HTTP listeners.", "counter")
+	for _, station := range stations {
+		name := metrics.Label{Name: "station", Value: station.Name}
+		w.Sample("snowcast_station_sent_bytes_total", float64(station.bytesSent.Load()), name, metrics.Label{Name: "transport", Value: "udp"})
+		w.Sample("snowcast_station_sent_bytes_total", float64(station.httpBytes.Load()), name, metrics.Label{Name: "transport", Value: "http"})
+	}
+	w.Header("snowcast_station_sent_datagrams_total", "UDP datagrams sent by a station.", "counter")
+	for _, station := range stations {
+		w.Sample("snowcast_station_sent_datagrams_total", float64(station.datagrams.Load()), metrics.Label{Name: "station", Value: station.Name})
+	}
+	w.Header("snowcast_station_send_errors_total", "UDP datagrams a station could not send.", "counter")
+	for _, station := range stations {
+		w.Sample("snowcast_station_send_errors_total", float64(station.sendErrors.Load()), metrics.Label{Name: "station", Value: station.Name})
+	}
+	w.Header("snowcast_station_lag_seconds", "How far a station is behind its timeline, negative while it waits for the next chunk of song data.", "gauge")
+	for _, station := range stations {
+		w.Sample("snowcast_station_lag_seconds", station.Lag().Seconds(), metrics.Label{Name: "station", Value: station.Name})
+	}
+	w.Header("snowcast_station_skipped_seconds_total", "Playing time of the song data a station dropped because it was too far behind.", "counter")
+	for _, station := range stations {
+		w.Sample("snowcast_station_skipped_seconds_total", station.Skipped().Seconds(), metrics.Label{Name: "station", Value: station.Name})
+	}
+	w.Header("snowcast_station_pacing_lateness_seconds", "How much later than planned a station was done with each chunk of song data.", "histogram")
+	for _, station := range stations {
+		w.Histogram("snowcast_station_pacing_lateness_seconds", station.lateness, metrics.Label{Name: "station", Value: station.Name})
+	}
+}
@@ -0,0 +1,75 @@
+package kit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// build station definitions from command-line arguments
+// each argument is a file, a directory or a comma-separated list of files and directories
+// a station is named after its argument, an argument given again is named after its station number too, e.g. "a.mp3#1"
+func ParseStationDefs(args []string) ([]StationDef, error) {
+	defs := make([]StationDef, len(args))
+	names := make(map[string]bool, len(args))
+	for i, arg := range args {
+		playlist, err := NewPlaylist(strings.Split(arg, ",")...)
+		if err != nil {
+			return nil, err
+		}
+		name := arg
+		for j := i; names[name]; j++ {
+			name = fmt.Sprintf("%s#%d", arg, j)
+		}
+		names[name] = true
+		defs[i] = StationDef{Name: name, Playlist: playlist}
+	}
+	return defs, nil
+}
+
+// build an ordered playlist from a list of files and directories
+// the files in a directory are played in lexical order, subdirectories and hidden files are ignored
+func NewPlaylist(paths ...string) ([]string, error) {
+	var playlist []string
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		files, err := expand(path)
+		if err != nil {
+			return nil, err
+		}
+		playlist = append(playlist, files...)
+	}
+	if len(playlist) == 0 {
+		return nil, errors.New("empty playlist")
+	}
+	return playlist, nil
+}
+
+// return the path itself if it is a file, or the regular files directly inside it if it is a directory
+func expand(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no files in directory " + path)
+	}
+	return files, nil
+}
@@ -0,0 +1,163 @@
+package kit
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gopher9527/snowcast/pkg/protocol"
+)
+
+const sessionIDSize = 8 // a token is a session ID followed by the first bytes of its HMAC
+
+// a struct to bind clients to the address their listener registers from
+// song data of a registered client is sent from the registration socket, so it follows the mapping the
+// registration datagram opened in a NAT
+type Registrar struct {
+	conn     *net.UDPConn
+	key      []byte             // signs tokens, a new one is made each time the server starts
+	sessions map[uint64]*Client // clients that have been given a token
+	nextID   uint64             // session ID of the next token
+	mutex    sync.Mutex
+}
+
+// listen for registration datagrams on a UDP address
+func NewRegistrar(address string) (*Registrar, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, sha256.Size)
+	_, err = rand.Read(key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Registrar{conn: conn, key: key, sessions: make(map[uint64]*Client)}, nil
+}
+
+// return the UDP port registration datagrams are sent to
+func (r *Registrar) Port() uint16 {
+	return uint16(r.conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// give a client a token, its listener registers with it
+func (r *Registrar) Token(client *Client) []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	id := r.nextID
+	r.nextID++
+	r.sessions[id] = client
+	return r.sign(id)
+}
+
+// drop the token of a client that has disconnected
+func (r *Registrar) Forget(client *Client) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for id, c := range r.sessions {
+		if c == client {
+			delete(r.sessions, id)
+		}
+	}
+}
+
+func (r *Registrar) sign(id uint64) []byte {
+	token := make([]byte, sessionIDSize, protocol.TokenSize)
+	binary.BigEndian.PutUint64(token, id)
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write(token)
+	return append(token, mac.Sum(nil)[:protocol.TokenSize-sessionIDSize]...)
+}
+
+// return the client a token was given to, or nil if the token is forged or the client has disconnected
+func (r *Registrar) lookup(token []byte) *Client {
+	id := binary.BigEndian.Uint64(token)
+	if !hmac.Equal(token, r.sign(id)) {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.sessions[id]
+}
+
+// read registration datagrams and send the song data of each client to the address its token came from
+// a listener registers again now and then to keep the NAT mapping open, a new address replaces the old one
+func (r *Registrar) Serve() {
+	buf := make([]byte, protocol.RegistrationSize+1) // one more byte to notice a datagram that is too long
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			logger.Debug("registrar stopped", "err", err)
+			return // the socket has been closed
+		}
+		token, err := protocol.ParseRegistration(buf[:n])
+		if err != nil {
+			logger.Debug("ignored datagram on the registration port", "from", addr.String(), "err", err)
+			continue
+		}
+		client := r.lookup(token)
+		if client == nil {
+			logger.Debug("ignored registration with a forged or stale token", "from", addr.String())
+			continue
+		}
+		if client.UdpAddr() != addr.String() {
+			logger.Info("listener registered", "client", client.ID, "udp", addr.String())
+		}
+		client.setUdp(&registeredConn{r.conn, addr})
+	}
+}
+
+func (r *Registrar) Close() error {
+	return r.conn.Close()
+}
+
+// a struct to send to a registered address from the shared registration socket
+type registeredConn struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+}
+
+func (c *registeredConn) Write(b []byte) (int, error) {
+	return c.conn.WriteToUDP(b, c.addr)
+}
+
+func (c *registeredConn) Read(b []byte) (int, error) {
+	return 0, net.ErrClosed // song data only goes out
+}
+
+// the registration socket is shared, it is only closed by the Registrar
+func (c *registeredConn) Close() error {
+	return nil
+}
+
+func (c *registeredConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *registeredConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *registeredConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *registeredConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *registeredConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
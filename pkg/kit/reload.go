@@ -0,0 +1,153 @@
+package kit
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/gopher9527/snowcast/pkg/protocol"
+)
+
+// a struct to summarize what a reload has changed
+type ReloadResult struct {
+	Added     int // new stations
+	Removed   int // retired stations
+	Updated   int // stations whose playlist, rate or multicast group has changed
+	Unchanged int // stations that keep streaming untouched
+}
+
+func (r ReloadResult) String() string {
+	return fmt.Sprintf("%d added, %d removed, %d updated, %d unchanged", r.Added, r.Removed, r.Updated, r.Unchanged)
+}
+
+// replace the stations with new definitions without dropping any control connection
+// stations are matched by name, so a station defined before and after the reload keeps streaming with no gap,
+// listeners of a removed station are moved to the first station, or closed with an InvalidCommand if none is left
+// definitions that use a name twice are refused and the stations are left unchanged
+func (s *State) Reload(defs []StationDef) (ReloadResult, error) {
+	err := checkNames(defs)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	return s.reload(defs), nil
+}
+
+// return an error if two definitions have the same name, a reload could not tell their stations apart
+func checkNames(defs []StationDef) error {
+	names := make(map[string]bool, len(defs))
+	for _, def := range defs {
+		if names[def.Name] {
+			return fmt.Errorf("%w: %s", ErrDuplicateName, def.Name)
+		}
+		names[def.Name] = true
+	}
+	return nil
+}
+
+func (s *State) reload(defs []StationDef) ReloadResult {
+	var result ReloadResult
+	s.stationsMutex.Lock()
+	old := make(map[string]*Station, len(s.stations))
+	for _, station := range s.stations {
+		old[station.Name] = station
+	}
+	stations := make([]*Station, len(defs))
+	var regrouped []*Station // stations whose multicast group has changed
+	for i, def := range defs {
+		station, ok := old[def.Name]
+		if !ok {
+			station = s.newStation(def)
+			go start(station, s) // start a new goroutine to send out song data
+			result.Added++
+		} else if group := station.MulticastGroup(); station.update(def) {
+			delete(old, def.Name)
+			result.Updated++
+			if def.Group != group {
+				regrouped = append(regrouped, station)
+			}
+		} else {
+			delete(old, def.Name)
+			result.Unchanged++
+		}
+		stations[i] = station
+	}
+	s.stations = stations
+	s.stationsMutex.Unlock()
+
+	for _, station := range regrouped {
+		regroup(station)
+	}
+
+	var fallback *Station
+	if len(stations) > 0 {
+		fallback = stations[0]
+	}
+	for _, station := range old {
+		close(station.stop) // stop sending song data
+		s.retire(station, fallback)
+		result.Removed++
+	}
+	return result
+}
+
+// change the playlist, the rate and the multicast group of a station, the song currently playing is not interrupted
+// return false if nothing has changed
+func (s *Station) update(def StationDef) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ByteRate == def.ByteRate && s.Group == def.Group && reflect.DeepEqual(s.Playlist, def.Playlist) {
+		return false
+	}
+	// carry on from the song currently playing if it is still in the playlist, otherwise start over after it
+	track := -1
+	for i, song := range def.Playlist {
+		if song == s.Filename {
+			track = i
+			break
+		}
+	}
+	s.track = track
+	s.Playlist = def.Playlist
+	s.ByteRate = def.ByteRate
+	s.Group = def.Group // listeners that asked for multicast are told about a new group by regroup
+	return true
+}
+
+// tell the listeners of a station that asked for multicast the new group of the station
+// until their listener joins it they miss song data, as they would after a SetStation
+func regroup(station *Station) {
+	group := station.MulticastGroup()
+	for _, client := range station.Listeners() {
+		if client.Features&protocol.FeatureMulticast == 0 {
+			continue
+		}
+		client.mutex.Lock()
+		moved := client.station != station // the client switched stations since the snapshot
+		if !moved {
+			client.group = group
+		}
+		client.mutex.Unlock()
+		if !moved {
+			tellGroup(client)
+			logger.Info("listener told the new group of its station", "client", client.ID, "station", station.Name, "group", group)
+		}
+	}
+}
+
+// move all listeners of a removed station to the fallback station
+func (s *State) retire(station *Station, fallback *Station) {
+	for _, client := range station.Listeners() {
+		if fallback == nil {
+			select {
+			case client.KickChan <- fmt.Sprintf("station %s has been removed", station.Name):
+			default: // the client is already being closed
+			}
+			continue
+		}
+		// tell the client the group of the fallback station, if it asked for multicast, and what it is playing
+		if s.relocate(client, fallback) {
+			logger.Info("listener moved off a removed station", "client", client.ID, "from", station.Name, "to", fallback.Name)
+		}
+	}
+}
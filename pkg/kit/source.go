@@ -0,0 +1,142 @@
+package kit
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/gopher9527/snowcast/pkg/id3"
+	"github.com/gopher9527/snowcast/pkg/mp3"
+)
+
+const maxDatagramSize = 1400 // whole frames are packed into a datagram up to this size, so it fits in an Ethernet MTU
+
+// a interface to cut a song into chunks of song data
+type source interface {
+	next() ([]byte, time.Duration, error) // return a chunk and how long it plays, or io.EOF at the end of the song
+	byteRate() int                        // return the average bytes sent per second
+	Close() error
+}
+
+// open a song as MPEG audio frames if it has any, otherwise as raw bytes, and return the name to announce for it
+// ID3 tags are parsed for the name and are never sent as song data
+// byteRate is the configured rate of the station, 0 means the rate of the song
+func openSource(filename string, byteRate int) (source, string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, "", err
+	}
+	name := filename
+	tag, err := id3.Read(file)
+	if err == nil && tag.String() != "" {
+		name = tag.String()
+	}
+	start, end, err := id3.Locate(file)
+	if err != nil {
+		file.Close()
+		return nil, "", err
+	}
+	reader := mp3.NewReader(io.NewSectionReader(file, start, end-start))
+	frame, h, err := reader.ReadFrame()
+	if err == nil {
+		f := &frameSource{file: file, reader: reader, frame: frame, header: h, rate: byteRate, paced: byteRate != 0}
+		if !f.paced {
+			// follow the duration of each frame, which matches the rate of the song even if it varies
+			f.rate = f.songByteRate()
+		}
+		return f, name, nil
+	}
+	// not an MP3 file, stream it from the beginning of the audio in fixed chunks
+	if byteRate == 0 {
+		byteRate = DefaultByteRate
+	}
+	return &rawSource{file: file, audio: io.NewSectionReader(file, start, end-start), rate: byteRate}, name, nil
+}
+
+// a struct to send a file in fixed-size chunks at a constant rate
+type rawSource struct {
+	file  *os.File
+	audio io.Reader // the file without its ID3 tags
+	rate  int       // bytes per second
+}
+
+func (r *rawSource) next() ([]byte, time.Duration, error) {
+	data := make([]byte, r.rate/count) // read a chunk from the file
+	n, err := io.ReadFull(r.audio, data)
+	if n == 0 {
+		if err == nil || err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, 0, err
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = nil // the last chunk of the file, the next call returns io.EOF
+	}
+	return data[:n], time.Duration(n) * time.Second / time.Duration(r.rate), err
+}
+
+func (r *rawSource) byteRate() int {
+	return r.rate
+}
+
+func (r *rawSource) Close() error {
+	return r.file.Close()
+}
+
+// a struct to send whole MPEG audio frames at the rate given by their headers
+type frameSource struct {
+	file   *os.File
+	reader *mp3.Reader
+	frame  []byte     // a frame that has been read but not sent yet
+	header mp3.Header // header of the pending frame
+	rate   int        // bytes per second
+	paced  bool       // pace frames by rate instead of their own duration
+}
+
+// work out the rate of the song from the Xing, Info or VBRI header if there is one, otherwise from the first frame
+// the frame holding such a header is silent and is dropped
+func (f *frameSource) songByteRate() int {
+	info, ok := mp3.ParseVBRInfo(f.frame, f.header)
+	if !ok {
+		return f.header.Bitrate / 8
+	}
+	first := f.header
+	frame, h, err := f.reader.ReadFrame()
+	if err == nil {
+		f.frame, f.header = frame, h
+	}
+	if rate := info.ByteRate(first); rate > 0 {
+		return rate
+	}
+	return f.header.Bitrate / 8
+}
+
+// pack as many whole frames as fit in a datagram, a frame larger than a datagram is sent on its own
+func (f *frameSource) next() ([]byte, time.Duration, error) {
+	if f.frame == nil {
+		return nil, 0, io.EOF
+	}
+	var data []byte
+	var duration time.Duration
+	for f.frame != nil && (len(data) == 0 || len(data)+len(f.frame) <= maxDatagramSize) {
+		data = append(data, f.frame...)
+		duration += f.header.Duration()
+		frame, h, err := f.reader.ReadFrame()
+		if err != nil && err != io.EOF && err != mp3.ErrNoFrame {
+			return nil, 0, err
+		}
+		f.frame, f.header = frame, h // nil at the end of the audio
+	}
+	if f.paced {
+		duration = time.Duration(len(data)) * time.Second / time.Duration(f.rate)
+	}
+	return data, duration, nil
+}
+
+func (f *frameSource) byteRate() int {
+	return f.rate
+}
+
+func (f *frameSource) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,147 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// a struct to describe where log records go and which ones are kept
+type Config struct {
+	Output     io.Writer             // where records are written, os.Stderr if nil
+	Format     string                // "text" or "json", "text" if empty
+	Level      slog.Level            // records below this level are dropped
+	Components map[string]slog.Level // levels of components that differ from Level, e.g. "kit" for pkg/kit
+}
+
+// records are written to stderr as text from info up until Setup is called
+var current atomic.Pointer[setup]
+
+// a struct to hold the handler every component writes through and the levels it filters with
+type setup struct {
+	handler    slog.Handler
+	level      slog.Level
+	components map[string]slog.Level
+}
+
+func init() {
+	Setup(Config{})
+}
+
+// change where the records of all loggers go and which ones are kept, loggers made before are affected too
+func Setup(c Config) error {
+	if c.Output == nil {
+		c.Output = os.Stderr
+	}
+	// every record passes the inner handler, components are filtered before it
+	options := &slog.HandlerOptions{Level: slog.Level(-1 << 10)}
+	var handler slog.Handler
+	switch c.Format {
+	case "", "text":
+		handler = slog.NewTextHandler(c.Output, options)
+	case "json":
+		handler = slog.NewJSONHandler(c.Output, options)
+	default:
+		return fmt.Errorf("unknown log format %q, use text or json", c.Format)
+	}
+	current.Store(&setup{handler, c.Level, c.Components})
+	return nil
+}
+
+// return the logger of a component, its records have a "component" attribute
+func Logger(component string) *slog.Logger {
+	return slog.New(&componentHandler{component: component}).With("component", component)
+}
+
+// log a record at the error level and exit, the same as log.Fatalln does
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// parse a level spec such as "info" or "warn,kit=debug,server=info"
+// the part without a component is the level of every component not listed, it is info if missing
+func ParseLevels(spec string) (slog.Level, map[string]slog.Level, error) {
+	level := slog.LevelInfo
+	components := make(map[string]slog.Level)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		component, name, found := strings.Cut(part, "=")
+		if !found {
+			name = component
+		}
+		var l slog.Level
+		err := l.UnmarshalText([]byte(name))
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid log level %q, use debug, info, warn or error", name)
+		}
+		if found {
+			components[component] = l
+		} else {
+			level = l
+		}
+	}
+	return level, components, nil
+}
+
+// a struct to filter the records of a component by its level and pass them to the current handler
+// attributes and groups added with With are replayed on the current handler, so Setup may be called at any time
+// the handler they derive is kept until the next Setup, so they are not replayed on every record
+type componentHandler struct {
+	component string
+	steps     []func(slog.Handler) slog.Handler // WithAttrs and WithGroup calls in order
+	derived   atomic.Pointer[derived]           // the steps replayed on the handler of a setup
+}
+
+// a struct to hold the handler derived from the handler of a setup
+type derived struct {
+	setup   *setup // each Setup stores a new one, so it tells whether the handler is out of date
+	handler slog.Handler
+}
+
+func (h *componentHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	s := current.Load()
+	min, ok := s.components[h.component]
+	if !ok {
+		min = s.level
+	}
+	return level >= min
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	s := current.Load()
+	d := h.derived.Load()
+	if d == nil || d.setup != s {
+		handler := s.handler
+		for _, step := range h.steps {
+			handler = step(handler)
+		}
+		d = &derived{s, handler}
+		h.derived.Store(d)
+	}
+	return d.handler.Handle(ctx, r)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithAttrs(attrs)
+	})
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithGroup(name)
+	})
+}
+
+func (h *componentHandler) with(step func(slog.Handler) slog.Handler) slog.Handler {
+	steps := append(append(make([]func(slog.Handler) slog.Handler, 0, len(h.steps)+1), h.steps...), step)
+	return &componentHandler{component: h.component, steps: steps}
+}
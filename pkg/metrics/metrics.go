@@ -0,0 +1,166 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// a struct to name a dimension of a metric, e.g. the station a sample belongs to
+type Label struct {
+	Name  string
+	Value string
+}
+
+// a struct to count events of several kinds, e.g. handshake failures by reason
+type CounterVec struct {
+	name   string
+	help   string
+	label  string            // name of the label that tells the kinds apart
+	values map[string]uint64 // count of each kind seen so far
+	mutex  sync.Mutex
+}
+
+func NewCounterVec(name, help, label string) *CounterVec {
+	return &CounterVec{name: name, help: help, label: label, values: make(map[string]uint64)}
+}
+
+// count one event of a kind
+func (c *CounterVec) Inc(value string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[value]++
+}
+
+// write the count of every kind, in the order of their names
+func (c *CounterVec) Collect(w *Writer) {
+	c.mutex.Lock()
+	values := make([]string, 0, len(c.values))
+	for value := range c.values {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	counts := make([]uint64, len(values))
+	for i, value := range values {
+		counts[i] = c.values[value]
+	}
+	c.mutex.Unlock()
+	w.Header(c.name, c.help, "counter")
+	for i, value := range values {
+		w.Sample(c.name, float64(counts[i]), Label{c.label, value})
+	}
+}
+
+// a struct to count observations in cumulative buckets, e.g. how late each tick of a station is
+type Histogram struct {
+	bounds []float64 // upper bounds of the buckets in increasing order, +Inf is implied
+	counts []uint64  // observations in each bucket, not cumulative
+	sum    float64
+	count  uint64
+	mutex  sync.Mutex
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v) // the first bucket whose bound is not below v
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// a struct to write metrics in the Prometheus text exposition format
+// the samples of a metric must follow its header without samples of other metrics in between
+type Writer struct {
+	w *bufio.Writer
+}
+
+// write the HELP and TYPE lines of a metric
+func (w *Writer) Header(name, help, kind string) {
+	fmt.Fprintf(w.w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w.w, "# TYPE %s %s\n", name, kind)
+}
+
+// write a sample of a metric
+func (w *Writer) Sample(name string, value float64, labels ...Label) {
+	w.w.WriteString(name)
+	if len(labels) > 0 {
+		w.w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.w.WriteByte(',')
+			}
+			fmt.Fprintf(w.w, `%s="%s"`, label.Name, escape(label.Value))
+		}
+		w.w.WriteByte('}')
+	}
+	w.w.WriteByte(' ')
+	w.w.WriteString(formatValue(value))
+	w.w.WriteByte('\n')
+}
+
+// write the buckets, the sum and the count of a histogram, its header must have been written with kind "histogram"
+func (w *Writer) Histogram(name string, h *Histogram, labels ...Label) {
+	h.mutex.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mutex.Unlock()
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += counts[i]
+		w.Sample(name+"_bucket", float64(cumulative), with(labels, Label{"le", formatValue(bound)})...)
+	}
+	w.Sample(name+"_bucket", float64(count), with(labels, Label{"le", "+Inf"})...)
+	w.Sample(name+"_sum", sum, labels...)
+	w.Sample(name+"_count", float64(count), labels...)
+}
+
+// return a handler which answers GET /metrics with the metrics collect writes
+func Handler(collect func(w *Writer)) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			http.NotFound(rw, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			rw.Header().Set("Allow", "GET, HEAD")
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if r.Method == http.MethodHead {
+			return
+		}
+		w := &Writer{bufio.NewWriter(rw)}
+		collect(w)
+		w.w.Flush()
+	})
+}
+
+// return the labels followed by one more, without touching the array of labels
+func with(labels []Label, label Label) []Label {
+	return append(append(make([]Label, 0, len(labels)+1), labels...), label)
+}
+
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,169 @@
+package mp3
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	HeaderSize = 4    // size of an MPEG audio frame header
+	maxJunk    = 8192 // give up looking for a frame after skipping this many bytes
+)
+
+const (
+	MPEG1  = 1 // MPEG-1
+	MPEG2  = 2 // MPEG-2 LSF
+	MPEG25 = 3 // unofficial MPEG-2.5
+)
+
+var (
+	ErrNoSync     = errors.New("no frame sync")
+	ErrBadHeader  = errors.New("invalid frame header")
+	ErrFreeFormat = errors.New("free format bitrate is not supported")
+	ErrNoFrame    = errors.New("no MPEG audio frame found")
+)
+
+// bitrates in kbit/s indexed by the 4-bit bitrate index of the header, 0 is free format and 15 is invalid
+var (
+	bitratesV1L1  = [16]int{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0}
+	bitratesV1L2  = [16]int{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0}
+	bitratesV1L3  = [16]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+	bitratesV2L1  = [16]int{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0}
+	bitratesV2L23 = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+)
+
+// sample rates in Hz of MPEG-1 indexed by the 2-bit sample rate index, MPEG-2 halves them and MPEG-2.5 quarters them
+var sampleRates = [4]int{44100, 48000, 32000, 0}
+
+// a struct to represent an MPEG audio frame header
+type Header struct {
+	Version    int  // MPEG1, MPEG2 or MPEG25
+	Layer      int  // 1, 2 or 3
+	Bitrate    int  // bit/s
+	SampleRate int  // Hz
+	Padding    bool // the frame has one extra slot
+	Mono       bool // the frame has a single channel
+	Size       int  // bytes of the whole frame including the header
+	Samples    int  // samples per channel in the frame
+}
+
+// parse the first 4 bytes of b as a frame header
+func ParseHeader(b []byte) (Header, error) {
+	var h Header
+	if len(b) < HeaderSize {
+		return h, io.ErrUnexpectedEOF
+	}
+	if b[0] != 0xFF || b[1]&0xE0 != 0xE0 { // 11 bits of frame sync
+		return h, ErrNoSync
+	}
+	switch (b[1] >> 3) & 0x03 {
+	case 0:
+		h.Version = MPEG25
+	case 2:
+		h.Version = MPEG2
+	case 3:
+		h.Version = MPEG1
+	default: // reserved
+		return h, ErrBadHeader
+	}
+	h.Layer = 4 - int((b[1]>>1)&0x03) // 0 is reserved and becomes 4
+	if h.Layer == 4 {
+		return h, ErrBadHeader
+	}
+	bitrateIndex := b[2] >> 4
+	if bitrateIndex == 0 {
+		return h, ErrFreeFormat
+	}
+	var bitrates *[16]int
+	switch {
+	case h.Version == MPEG1 && h.Layer == 1:
+		bitrates = &bitratesV1L1
+	case h.Version == MPEG1 && h.Layer == 2:
+		bitrates = &bitratesV1L2
+	case h.Version == MPEG1:
+		bitrates = &bitratesV1L3
+	case h.Layer == 1:
+		bitrates = &bitratesV2L1
+	default:
+		bitrates = &bitratesV2L23
+	}
+	h.Bitrate = bitrates[bitrateIndex] * 1000
+	h.SampleRate = sampleRates[(b[2]>>2)&0x03]
+	if h.Bitrate == 0 || h.SampleRate == 0 {
+		return h, ErrBadHeader
+	}
+	if h.Version == MPEG2 {
+		h.SampleRate /= 2
+	} else if h.Version == MPEG25 {
+		h.SampleRate /= 4
+	}
+	h.Padding = b[2]&0x02 != 0
+	h.Mono = b[3]>>6 == 3
+	padding := 0
+	if h.Padding {
+		padding = 1
+	}
+	switch {
+	case h.Layer == 1:
+		h.Samples = 384
+		h.Size = (12*h.Bitrate/h.SampleRate + padding) * 4 // a slot of layer I is 4 bytes
+	case h.Layer == 2 || h.Version == MPEG1:
+		h.Samples = 1152
+		h.Size = 144*h.Bitrate/h.SampleRate + padding
+	default: // layer III of MPEG-2 and MPEG-2.5
+		h.Samples = 576
+		h.Size = 72*h.Bitrate/h.SampleRate + padding
+	}
+	return h, nil
+}
+
+// return how long the frame plays
+func (h Header) Duration() time.Duration {
+	return time.Duration(h.Samples) * time.Second / time.Duration(h.SampleRate)
+}
+
+// a struct to read whole MPEG audio frames from a stream
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{bufio.NewReaderSize(r, 8192)}
+}
+
+// return the next whole frame, skipping any bytes that are not part of a frame
+// return io.EOF at the end of the stream, and ErrNoFrame if no frame can be found nearby
+func (r *Reader) ReadFrame() ([]byte, Header, error) {
+	for skipped := 0; skipped <= maxJunk; skipped++ {
+		b, err := r.r.Peek(HeaderSize)
+		if err != nil {
+			if len(b) == 0 || err != io.EOF {
+				return nil, Header{}, err
+			}
+			return nil, Header{}, io.EOF // a few trailing bytes that cannot be a frame
+		}
+		h, err := ParseHeader(b)
+		if err == nil && r.synced(h) {
+			frame := make([]byte, h.Size)
+			_, err = io.ReadFull(r.r, frame)
+			if err == io.ErrUnexpectedEOF {
+				return nil, Header{}, io.EOF // drop a truncated last frame
+			}
+			return frame, h, err
+		}
+		r.r.Discard(1) // not a frame here, move on by one byte
+	}
+	return nil, Header{}, ErrNoFrame
+}
+
+// check that the frame is followed by another frame or the end of the stream, so a sync pattern in junk is not taken for a frame
+func (r *Reader) synced(h Header) bool {
+	b, err := r.r.Peek(h.Size + HeaderSize)
+	if err != nil {
+		return len(b) >= h.Size // the last frame of the stream
+	}
+	next, err := ParseHeader(b[h.Size:])
+	return err == nil && next.Version == h.Version && next.Layer == h.Layer && next.SampleRate == h.SampleRate
+}
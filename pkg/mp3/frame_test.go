@@ -0,0 +1,172 @@
+package mp3
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// return a silent frame that starts with a header
+func frame(t *testing.T, header ...byte) []byte {
+	t.Helper()
+	h, err := ParseHeader(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, h.Size)
+	copy(b, header)
+	return b
+}
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   Header
+	}{
+		{"MPEG1 layer III 128k 44.1kHz", []byte{0xFF, 0xFB, 0x90, 0x00},
+			Header{MPEG1, 3, 128000, 44100, false, false, 417, 1152}},
+		{"MPEG1 layer III padded mono", []byte{0xFF, 0xFB, 0x92, 0xC0},
+			Header{MPEG1, 3, 128000, 44100, true, true, 418, 1152}},
+		{"MPEG1 layer III 320k 48kHz", []byte{0xFF, 0xFB, 0xE4, 0x00},
+			Header{MPEG1, 3, 320000, 48000, false, false, 960, 1152}},
+		{"MPEG2 layer III 64k 22.05kHz", []byte{0xFF, 0xF3, 0x80, 0x00},
+			Header{MPEG2, 3, 64000, 22050, false, false, 208, 576}},
+		{"MPEG2 layer III 8k 16kHz", []byte{0xFF, 0xF3, 0x18, 0x00},
+			Header{MPEG2, 3, 8000, 16000, false, false, 36, 576}},
+		{"MPEG2.5 layer III 64k 11.025kHz", []byte{0xFF, 0xE3, 0x80, 0x00},
+			Header{MPEG25, 3, 64000, 11025, false, false, 417, 576}},
+		{"MPEG2.5 layer III 8k 8kHz", []byte{0xFF, 0xE3, 0x1A, 0xC0},
+			Header{MPEG25, 3, 8000, 8000, true, true, 73, 576}},
+		{"MPEG1 layer II", []byte{0xFF, 0xFD, 0x90, 0x00},
+			Header{MPEG1, 2, 160000, 44100, false, false, 522, 1152}},
+		{"MPEG1 layer I", []byte{0xFF, 0xFF, 0x90, 0x00},
+			Header{MPEG1, 1, 288000, 44100, false, false, 312, 384}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, err := ParseHeader(test.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h != test.want {
+				t.Errorf("got %+v, want %+v", h, test.want)
+			}
+		})
+	}
+}
+
+func TestParseHeaderErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   error
+	}{
+		{"short", []byte{0xFF, 0xFB, 0x90}, io.ErrUnexpectedEOF},
+		{"no sync", []byte{0x00, 0xFB, 0x90, 0x00}, ErrNoSync},
+		{"partial sync", []byte{0xFF, 0x1B, 0x90, 0x00}, ErrNoSync},
+		{"ID3 tag", []byte("ID3\x03"), ErrNoSync},
+		{"reserved version", []byte{0xFF, 0xEB, 0x90, 0x00}, ErrBadHeader},
+		{"reserved layer", []byte{0xFF, 0xF9, 0x90, 0x00}, ErrBadHeader},
+		{"free format", []byte{0xFF, 0xFB, 0x00, 0x00}, ErrFreeFormat},
+		{"free format MPEG2", []byte{0xFF, 0xF3, 0x04, 0x00}, ErrFreeFormat},
+		{"invalid bitrate", []byte{0xFF, 0xFB, 0xF0, 0x00}, ErrBadHeader},
+		{"reserved sample rate", []byte{0xFF, 0xFB, 0x9C, 0x00}, ErrBadHeader},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseHeader(test.header)
+			if !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestDuration(t *testing.T) {
+	tests := []struct {
+		header []byte
+		want   time.Duration
+	}{
+		{[]byte{0xFF, 0xFB, 0x90, 0x00}, 1152 * time.Second / 44100},
+		{[]byte{0xFF, 0xFB, 0x94, 0x00}, 24 * time.Millisecond},
+		{[]byte{0xFF, 0xF3, 0x88, 0x00}, 36 * time.Millisecond},
+		{[]byte{0xFF, 0xE3, 0x88, 0x00}, 72 * time.Millisecond},
+	}
+	for _, test := range tests {
+		h, err := ParseHeader(test.header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Duration() != test.want {
+			t.Errorf("% x: got %v, want %v", test.header, h.Duration(), test.want)
+		}
+	}
+}
+
+// return the frames of a stream
+func readAll(t *testing.T, stream []byte) [][]byte {
+	t.Helper()
+	r := NewReader(bytes.NewReader(stream))
+	var frames [][]byte
+	for {
+		frame, _, err := r.ReadFrame()
+		if err == io.EOF {
+			return frames
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	a := frame(t, 0xFF, 0xFB, 0x90, 0x00)
+	b := frame(t, 0xFF, 0xFB, 0x92, 0x00) // padded, so one byte longer
+	c := frame(t, 0xFF, 0xF3, 0x80, 0x00)
+	fake := []byte{0xFF, 0xFB, 0x90, 0x00, 1, 2, 3} // a sync pattern that is not followed by another frame
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	tests := []struct {
+		name   string
+		stream []byte
+		want   [][]byte
+	}{
+		{"empty", nil, nil},
+		{"frames", join(a, b, a), [][]byte{a, b, a}},
+		{"MPEG2", join(c, c), [][]byte{c, c}},
+		{"other version", join(a, c), [][]byte{c}}, // a is not followed by a frame like it, so it is taken for junk
+		{"junk before", join([]byte("junk"), a, b), [][]byte{a, b}},
+		{"junk between", join(a, b, []byte{0, 0xFF, 0}, a, b), [][]byte{a, a, b}}, // b is not followed by a frame, so it is taken for junk
+		{"false sync", join(fake, a, b), [][]byte{a, b}},
+		{"truncated last frame", join(a, b, a[:100]), [][]byte{a, b}},
+		{"trailing bytes", join(a, []byte{1, 2}), [][]byte{a}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frames := readAll(t, test.stream)
+			if len(frames) != len(test.want) {
+				t.Fatalf("got %d frames, want %d", len(frames), len(test.want))
+			}
+			for i := range frames {
+				if !bytes.Equal(frames[i], test.want[i]) {
+					t.Errorf("frame %d: got %d bytes starting with % x, want %d bytes starting with % x",
+						i, len(frames[i]), frames[i][:4], len(test.want[i]), test.want[i][:4])
+				}
+			}
+		})
+	}
+}
+
+// a stream without frames is given up on instead of being read to the end
+func TestReadFrameNoFrame(t *testing.T) {
+	stream := make([]byte, 4*maxJunk)
+	_, _, err := NewReader(bytes.NewReader(stream)).ReadFrame()
+	if err != ErrNoFrame {
+		t.Errorf("got %v, want ErrNoFrame", err)
+	}
+}
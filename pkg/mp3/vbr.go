@@ -0,0 +1,60 @@
+package mp3
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// a struct to represent the totals stored in a Xing, Info or VBRI header
+// encoders put such a header in a silent first frame, mostly for variable bitrate files
+type VBRInfo struct {
+	Frames int // number of audio frames in the file, 0 if unknown
+	Bytes  int // number of bytes of audio in the file, 0 if unknown
+}
+
+// look for a Xing, Info or VBRI header in a frame
+func ParseVBRInfo(frame []byte, h Header) (VBRInfo, bool) {
+	// the Xing header comes right after the side information, whose size depends on the version and channels
+	offset := HeaderSize
+	switch {
+	case h.Version == MPEG1 && !h.Mono:
+		offset += 32
+	case h.Version == MPEG1 || !h.Mono:
+		offset += 17
+	default:
+		offset += 9
+	}
+	if len(frame) >= offset+8 {
+		tag := frame[offset : offset+4]
+		if bytes.Equal(tag, []byte("Xing")) || bytes.Equal(tag, []byte("Info")) {
+			var info VBRInfo
+			flags := binary.BigEndian.Uint32(frame[offset+4:])
+			field := offset + 8
+			if flags&0x01 != 0 && len(frame) >= field+4 { // number of frames
+				info.Frames = int(binary.BigEndian.Uint32(frame[field:]))
+				field += 4
+			}
+			if flags&0x02 != 0 && len(frame) >= field+4 { // number of bytes
+				info.Bytes = int(binary.BigEndian.Uint32(frame[field:]))
+			}
+			return info, true
+		}
+	}
+	// the VBRI header of the Fraunhofer encoder is always 32 bytes after the frame header
+	offset = HeaderSize + 32
+	if len(frame) >= offset+18 && bytes.Equal(frame[offset:offset+4], []byte("VBRI")) {
+		return VBRInfo{
+			Bytes:  int(binary.BigEndian.Uint32(frame[offset+10:])),
+			Frames: int(binary.BigEndian.Uint32(frame[offset+14:])),
+		}, true
+	}
+	return VBRInfo{}, false
+}
+
+// return the average bytes per second of the file, or 0 if the totals are unknown
+func (v VBRInfo) ByteRate(h Header) int {
+	if v.Frames == 0 || v.Bytes == 0 {
+		return 0
+	}
+	return int(int64(v.Bytes) * int64(h.SampleRate) / (int64(v.Frames) * int64(h.Samples)))
+}
@@ -0,0 +1,92 @@
+package mp3
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// return a frame with a Xing or Info header at offset, with the fields the flags ask for
+func xingFrame(t *testing.T, header []byte, offset int, tag string, flags uint32, frames uint32, bytes uint32) []byte {
+	t.Helper()
+	b := frame(t, header...)
+	copy(b[offset:], tag)
+	binary.BigEndian.PutUint32(b[offset+4:], flags)
+	field := offset + 8
+	if flags&0x01 != 0 {
+		binary.BigEndian.PutUint32(b[field:], frames)
+		field += 4
+	}
+	if flags&0x02 != 0 {
+		binary.BigEndian.PutUint32(b[field:], bytes)
+	}
+	return b
+}
+
+func TestParseVBRInfo(t *testing.T) {
+	stereo1 := []byte{0xFF, 0xFB, 0x90, 0x00}
+	mono1 := []byte{0xFF, 0xFB, 0x90, 0xC0}
+	stereo2 := []byte{0xFF, 0xF3, 0x80, 0x00}
+	mono2 := []byte{0xFF, 0xF3, 0x80, 0xC0}
+	vbri := frame(t, stereo1...)
+	copy(vbri[36:], "VBRI")
+	binary.BigEndian.PutUint32(vbri[46:], 4170000) // bytes
+	binary.BigEndian.PutUint32(vbri[50:], 10000)   // frames
+
+	tests := []struct {
+		name   string
+		header []byte
+		frame  []byte
+		found  bool
+		want   VBRInfo
+	}{
+		{"Xing MPEG1 stereo", stereo1, xingFrame(t, stereo1, 36, "Xing", 3, 1000, 417000), true, VBRInfo{1000, 417000}},
+		{"Xing MPEG1 mono", mono1, xingFrame(t, mono1, 21, "Xing", 3, 1000, 417000), true, VBRInfo{1000, 417000}},
+		{"Xing MPEG2 stereo", stereo2, xingFrame(t, stereo2, 21, "Xing", 3, 500, 104000), true, VBRInfo{500, 104000}},
+		{"Xing MPEG2 mono", mono2, xingFrame(t, mono2, 13, "Xing", 3, 500, 104000), true, VBRInfo{500, 104000}},
+		{"Info", stereo1, xingFrame(t, stereo1, 36, "Info", 3, 1000, 417000), true, VBRInfo{1000, 417000}},
+		{"Xing without bytes", stereo1, xingFrame(t, stereo1, 36, "Xing", 1, 1000, 0), true, VBRInfo{1000, 0}},
+		{"Xing without frames", stereo1, xingFrame(t, stereo1, 36, "Xing", 2, 0, 417000), true, VBRInfo{0, 417000}},
+		{"Xing at the mono offset of a stereo frame", stereo1, xingFrame(t, stereo1, 21, "Xing", 3, 1000, 417000), false, VBRInfo{}},
+		{"Xing cut short", stereo1, xingFrame(t, stereo1, 36, "Xing", 3, 1000, 417000)[:48], true, VBRInfo{1000, 0}},
+		{"VBRI", stereo1, vbri, true, VBRInfo{10000, 4170000}},
+		{"VBRI cut short", stereo1, vbri[:50], false, VBRInfo{}},
+		{"none", stereo1, frame(t, stereo1...), false, VBRInfo{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, err := ParseHeader(test.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, found := ParseVBRInfo(test.frame, h)
+			if found != test.found || info != test.want {
+				t.Errorf("got %+v and %v, want %+v and %v", info, found, test.want, test.found)
+			}
+		})
+	}
+}
+
+func TestByteRate(t *testing.T) {
+	mpeg1, _ := ParseHeader([]byte{0xFF, 0xFB, 0x90, 0x00})
+	mpeg2, _ := ParseHeader([]byte{0xFF, 0xF3, 0x80, 0x00})
+	tests := []struct {
+		name string
+		info VBRInfo
+		h    Header
+		want int
+	}{
+		// 1000 frames of 1152 samples at 44.1kHz play for 26.12s
+		{"MPEG1", VBRInfo{1000, 417000}, mpeg1, 417000 * 44100 / (1000 * 1152)},
+		// 500 frames of 576 samples at 22.05kHz play for 13.06s
+		{"MPEG2", VBRInfo{500, 104000}, mpeg2, 104000 * 22050 / (500 * 576)},
+		{"no frames", VBRInfo{0, 417000}, mpeg1, 0},
+		{"no bytes", VBRInfo{1000, 0}, mpeg1, 0},
+		{"large file", VBRInfo{1 << 20, 1 << 31}, mpeg1, int(int64(1<<31) * 44100 / (1 << 20 * 1152))},
+	}
+	for _, test := range tests {
+		got := test.info.ByteRate(test.h)
+		if got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// the time allowed for the rest of a message once its type has arrived, unless told otherwise
+const DefaultFrameTimeout = 100 * time.Millisecond
+
+// a interface for readers whose reads can time out, such as net.Conn
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// a interface for writers whose writes can time out, such as net.Conn
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// a struct to read messages from a stream, such as a connection, a pipe or a buffer
+type Decoder struct {
+	r            io.Reader
+	frameTimeout time.Duration // time allowed for the rest of a message once its type has arrived, 0 means no limit
+	maxFrameSize int           // the largest message accepted, 0 means no limit
+	registry     *Registry     // the message types understood
+}
+
+// a function to change how a Decoder behaves
+type DecoderOption func(*Decoder)
+
+// allow d for the rest of a message once its type has arrived, 0 means no limit
+// it only applies to readers with a SetReadDeadline method
+func WithFrameTimeout(d time.Duration) DecoderOption {
+	return func(dec *Decoder) {
+		dec.frameTimeout = d
+	}
+}
+
+// refuse messages larger than n bytes with an OversizedError before reading their strings, 0 means no limit
+func WithMaxFrameSize(n int) DecoderOption {
+	return func(dec *Decoder) {
+		dec.maxFrameSize = n
+	}
+}
+
+// understand the message types of registry instead of DefaultRegistry
+func WithRegistry(registry *Registry) DecoderOption {
+	return func(dec *Decoder) {
+		dec.registry = registry
+	}
+}
+
+func NewDecoder(r io.Reader, options ...DecoderOption) *Decoder {
+	d := &Decoder{r: r, frameTimeout: DefaultFrameTimeout, registry: DefaultRegistry}
+	for _, option := range options {
+		option(d)
+	}
+	return d
+}
+
+// read the next message
+// the deadline and the cancellation of ctx interrupt a reader with a SetReadDeadline method at any time,
+// other readers cannot be interrupted, so ctx is only checked before reading
+// io.EOF means the stream ended cleanly between messages, other errors are the typed errors of this package,
+// except context.Canceled when ctx is cancelled
+func (d *Decoder) Decode(ctx context.Context) (Message, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, contextError(err, false)
+	}
+	dl, ok := d.r.(readDeadliner)
+	if ok {
+		deadline, _ := ctx.Deadline() // a zero value means Read will not time out
+		dl.SetReadDeadline(deadline)
+		if ctx.Done() != nil {
+			// interrupt a blocked read as soon as ctx is cancelled
+			// wait for the goroutine before returning, so a cancellation after Decode has returned
+			// does not move the deadline of the next Decode on the same reader
+			done := make(chan int)
+			exited := make(chan int)
+			defer func() {
+				close(done)
+				<-exited
+			}()
+			go func() {
+				defer close(exited)
+				select {
+				case <-ctx.Done():
+					dl.SetReadDeadline(time.Now())
+				case <-done:
+				}
+			}()
+		}
+	}
+	m, err := d.decode(ctx, dl)
+	if err != nil && ctx.Err() != nil {
+		// report why the read was interrupted
+		var timeout *TimeoutError
+		return nil, contextError(ctx.Err(), errors.As(err, &timeout) && timeout.Partial)
+	}
+	return m, err
+}
+
+func contextError(err error, partial bool) error {
+	if err == context.DeadlineExceeded {
+		return &TimeoutError{Partial: partial, Err: err}
+	}
+	return err
+}
+
+// convert an error of the reader into an error of this package
+// got is the number of bytes of the message received before the error, want the number expected
+func readError(err error, t uint8, got int, want int) error {
+	var netErr interface{ Timeout() bool }
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &TimeoutError{Partial: got > 0, Err: err}
+	}
+	if got > 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+		return &TruncatedError{Type: t, Want: want, Got: got}
+	}
+	return err
+}
+
+func (d *Decoder) decode(ctx context.Context, dl readDeadliner) (Message, error) {
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(d.r, buf) // read message type
+	if err != nil {
+		return nil, readError(err, 0, 0, 1)
+	}
+	t := buf[0]
+	// check whether t is a valid message type
+	reg, ok := d.registry.Lookup(t)
+	if !ok {
+		return nil, &UnknownTypeError{t}
+	}
+	size := reg.Size
+	prefix := reg.Framing.prefix()
+	if dl != nil && d.frameTimeout > 0 {
+		// receive all of the remaining bytes of the message within the frame timeout, or before ctx expires
+		deadline := time.Now().Add(d.frameTimeout)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		dl.SetReadDeadline(deadline)
+	}
+
+	offset := 1 // starting position of the remaining part of the message in the buffer
+	if prefix > 0 {
+		buf = make([]byte, 1+prefix) // the buffer for the type and the size of the string
+		buf[0] = t
+		n, err := io.ReadFull(d.r, buf[1:]) // read size of remaining part
+		if err != nil {
+			return nil, readError(err, t, 1+n, 1+prefix)
+		}
+		if prefix == 1 {
+			size = int(buf[1])
+		} else {
+			size = int(binary.BigEndian.Uint16(buf[1:]))
+		}
+		offset += prefix
+	}
+	if d.maxFrameSize > 0 && offset+size > d.maxFrameSize {
+		return nil, &OversizedError{Type: t, Size: offset + size, Max: d.maxFrameSize}
+	}
+	message := make([]byte, offset+size) // the buffer for the message
+	copy(message, buf)
+	n, err := io.ReadFull(d.r, message[offset:]) // read the remaining bytes and store them in the buffer beginning at offset
+	if err != nil {
+		return nil, readError(err, t, offset+n, offset+size)
+	}
+	m := reg.New()
+	m.Unmarshal(message)
+	return m, nil
+}
+
+// a struct to write messages to a stream
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w}
+}
+
+// marshal a message and write it
+// the deadline of ctx applies to a writer with a SetWriteDeadline method, other writers cannot time out
+func (e *Encoder) Encode(ctx context.Context, m Message) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	buf, err := m.Marshal() // marshal message into a byte array
+	if err != nil {
+		return err
+	}
+	if dl, ok := e.w.(writeDeadliner); ok {
+		deadline, _ := ctx.Deadline() // a zero value means Write will not time out
+		dl.SetWriteDeadline(deadline)
+	}
+	_, err = e.w.Write(buf) // send it
+	return err
+}
@@ -0,0 +1,239 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// return a message built by a constructor that can fail
+func must[M Message](m M, err error) Message {
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// every message of DefaultRegistry, as it is sent
+func messages() []Message {
+	return []Message{
+		NewHello(16800),
+		NewSetStation(3),
+		NewWelcome(5),
+		must(NewAnnounce("song.mp3")),
+		must(NewAnnounce("")),
+		must(NewInvalidCommand("station 9 does not exist")),
+		NewExtHello(16800, Version4, FeatureDataHeader|FeatureMulticast),
+		NewExtWelcome(5, Version3, FeatureKeepalive),
+		must(NewLongAnnounce(string(bytes.Repeat([]byte("a"), MaxStringSize+1)))),
+		must(NewLongInvalidCommand("unknown message type 200")),
+		must(NewLongStationsReply("0,song.mp3\n1,other.mp3\n")),
+		NewLeave(),
+		must(NewGoodbye("server shutting down")),
+		NewPing(1),
+		NewPong(1<<32 - 1),
+		must(NewGroup("239.1.2.3:5000")),
+		NewToken(17000, bytes.Repeat([]byte{7}, TokenSize)),
+		NewStationsCommand(),
+		must(NewStationsReply("0,song.mp3\n")),
+	}
+}
+
+// each message comes out of a Decoder as it went into an Encoder, also when the reader returns a byte at a time
+func TestRoundTrip(t *testing.T) {
+	for _, m := range messages() {
+		want, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, oneByte := range []bool{false, true} {
+			var buf bytes.Buffer
+			err = NewEncoder(&buf).Encode(context.Background(), m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var r io.Reader = &buf
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			got, err := NewDecoder(r).Decode(context.Background())
+			if err != nil {
+				t.Fatalf("type %d: %v", m.GetType(), err)
+			}
+			if got.GetType() != m.GetType() {
+				t.Fatalf("type %d came back as type %d", m.GetType(), got.GetType())
+			}
+			data, err := got.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, want) {
+				t.Errorf("type %d: got % x, want % x", m.GetType(), data, want)
+			}
+		}
+	}
+}
+
+// the fields of the extended handshake survive the round trip
+func TestExtHandshake(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	decoder := NewDecoder(&buf)
+	ctx := context.Background()
+
+	err := encoder.Encode(ctx, NewExtHello(16800, Version4, FeatureDataHeader|FeatureRegister))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := decoder.Decode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello, ok := m.(*ExtHello)
+	if !ok || hello.UdpPort != 16800 || hello.Version != Version4 || hello.Features != FeatureDataHeader|FeatureRegister {
+		t.Fatalf("got %+v", m)
+	}
+
+	version, features := Negotiate(hello.Version, hello.Features, Version3, FeatureDataHeader|FeatureKeepalive)
+	err = encoder.Encode(ctx, NewExtWelcome(7, version, features))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = decoder.Decode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	welcome, ok := m.(*ExtWelcome)
+	if !ok || welcome.NumStations != 7 || welcome.Version != Version3 || welcome.Features != FeatureDataHeader {
+		t.Fatalf("got %+v", m)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	all := FeatureDataHeader | FeatureKeepalive | FeatureMulticast | FeatureRegister
+	tests := []struct {
+		name                           string
+		clientVersion, serverVersion   uint8
+		clientFeatures, serverFeatures uint32
+		version                        uint8
+		features                       uint32
+	}{
+		{"same", Version4, Version4, all, all, Version4, all},
+		{"older client", Version2, Version4, FeatureKeepalive, all, Version2, FeatureKeepalive},
+		{"older server", Version4, Version3, all, FeatureDataHeader, Version3, FeatureDataHeader},
+		{"no common features", Version4, Version4, FeatureMulticast, FeatureRegister, Version4, 0},
+		{"newer client", 200, ProtocolVersion, 1 << 31, all, ProtocolVersion, 0},
+	}
+	for _, test := range tests {
+		version, features := Negotiate(test.clientVersion, test.clientFeatures, test.serverVersion, test.serverFeatures)
+		if version != test.version || features != test.features {
+			t.Errorf("%s: got version %d and features %b, want version %d and features %b",
+				test.name, version, features, test.version, test.features)
+		}
+	}
+}
+
+// messages that follow each other on a stream are read one at a time, a clean end between them is io.EOF
+func TestDecodeStream(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	for _, m := range messages() {
+		err := encoder.Encode(context.Background(), m)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	decoder := NewDecoder(&buf)
+	for _, want := range messages() {
+		m, err := decoder.Decode(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.GetType() != want.GetType() {
+			t.Fatalf("got type %d, want type %d", m.GetType(), want.GetType())
+		}
+	}
+	_, err := decoder.Decode(context.Background())
+	if err != io.EOF {
+		t.Errorf("got %v at the end of the stream, want io.EOF", err)
+	}
+}
+
+// a message is not read once ctx is done
+func TestDecodeDoneContext(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{HelloCommandType, 0, 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewDecoder(&buf).Decode(ctx)
+	if err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if buf.Len() != 3 {
+		t.Errorf("%d bytes were read", 3-buf.Len())
+	}
+	err = NewEncoder(&buf).Encode(ctx, NewHello(1))
+	if err != context.Canceled {
+		t.Errorf("got %v from Encode, want context.Canceled", err)
+	}
+}
+
+// cancelling ctx interrupts a Decode that is waiting on a connection
+func TestDecodeCancel(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err := NewDecoder(server).Decode(ctx)
+	if err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+// the deadline of ctx applies to the writes of an Encoder on a connection
+func TestEncodeDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := NewEncoder(client).Encode(ctx, NewHello(1)) // nobody reads the other end
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("got %v, want a timeout", err)
+	}
+}
+
+// cancelling the ctx of a Decode that has returned does not interrupt the next Decode on the same connection,
+// as when a handshake with a timeout is followed by messages without one
+func TestDecodeAfterCancel(t *testing.T) {
+	for i := 0; i < 5000; i++ {
+		client, server := net.Pipe()
+		go func() {
+			encoder := NewEncoder(client)
+			encoder.Encode(context.Background(), NewHello(1))
+			runtime.Gosched() // let the next Decode wait for the message
+			encoder.Encode(context.Background(), NewHello(1))
+		}()
+		decoder := NewDecoder(server)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := decoder.Decode(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = decoder.Decode(context.Background())
+		client.Close()
+		server.Close()
+		if err != nil {
+			t.Fatalf("decode %d after a cancelled one: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const DataHeaderSize = 10 // size of a DataHeader on the wire
+
+// a header in front of the song data of a UDP datagram, sent to clients that have been granted FeatureDataHeader
+// it lets a listener detect lost, reordered and duplicated datagrams
+type DataHeader struct {
+	StationID uint16 // offset is 0, identifies the station, it does not change when stations are reloaded
+	Seq       uint32 // offset is 2, counts the datagrams of the station
+	Timestamp uint32 // offset is 6, playing time of the station in milliseconds when this song data starts
+}
+
+// return the header followed by the song data
+func (h DataHeader) Prepend(data []byte) []byte {
+	buf := make([]byte, DataHeaderSize+len(data))
+	binary.BigEndian.PutUint16(buf[0:], h.StationID)
+	binary.BigEndian.PutUint32(buf[2:], h.Seq)
+	binary.BigEndian.PutUint32(buf[6:], h.Timestamp)
+	copy(buf[DataHeaderSize:], data)
+	return buf
+}
+
+// split a datagram into its header and its song data
+func ParseDataHeader(datagram []byte) (DataHeader, []byte, error) {
+	if len(datagram) < DataHeaderSize {
+		return DataHeader{}, nil, errors.New("datagram too short for a data header")
+	}
+	h := DataHeader{
+		StationID: binary.BigEndian.Uint16(datagram[0:]),
+		Seq:       binary.BigEndian.Uint32(datagram[2:]),
+		Timestamp: binary.BigEndian.Uint32(datagram[6:]),
+	}
+	return h, datagram[DataHeaderSize:], nil
+}
@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errors to compare with errors.Is, the typed errors below carry the details
+var (
+	ErrUnknownType = errors.New("unknown message type")
+	ErrTruncated   = errors.New("truncated message")
+	ErrOversized   = errors.New("oversized message")
+	ErrTimeout     = errors.New("message timed out")
+	ErrUnexpected  = errors.New("unexpected message")
+)
+
+// a error for a message type that is not part of the protocol
+type UnknownTypeError struct {
+	Type uint8
+}
+
+func (e *UnknownTypeError) Error() string {
+	return fmt.Sprintf("unknown message type %d", e.Type)
+}
+
+func (e *UnknownTypeError) Is(target error) bool {
+	return target == ErrUnknownType
+}
+
+// a error for a stream that ends in the middle of a message
+type TruncatedError struct {
+	Type uint8
+	Want int // bytes of the message
+	Got  int // bytes received before the end of the stream
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("message of type %d truncated after %d of %d bytes", e.Type, e.Got, e.Want)
+}
+
+func (e *TruncatedError) Is(target error) bool {
+	return target == ErrTruncated
+}
+
+// a error for a message larger than its framing or the receiver allows
+type OversizedError struct {
+	Type uint8
+	Size int // bytes of the string or the message
+	Max  int // the most bytes allowed
+}
+
+func (e *OversizedError) Error() string {
+	return fmt.Sprintf("message of type %d has %d bytes, more than %d", e.Type, e.Size, e.Max)
+}
+
+func (e *OversizedError) Is(target error) bool {
+	return target == ErrOversized
+}
+
+// a error for a read that did not complete in time
+type TimeoutError struct {
+	Partial bool  // part of a message had arrived, so it was too slow rather than missing
+	Err     error // the error of the reader or the context
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Partial {
+		return "timed out in the middle of a message: " + e.Err.Error()
+	}
+	return "timed out waiting for a message: " + e.Err.Error()
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// a error for a valid message that is not allowed in the current state of the session
+type UnexpectedMessageError struct {
+	Type  uint8
+	State string // e.g. "handshake"
+}
+
+func (e *UnexpectedMessageError) Error() string {
+	return fmt.Sprintf("unexpected message of type %d during %s", e.Type, e.State)
+}
+
+func (e *UnexpectedMessageError) Is(target error) bool {
+	return target == ErrUnexpected
+}
+
+// errors of a Registry, compare with errors.Is
+var (
+	ErrDuplicateType       = errors.New("duplicate message type")
+	ErrInvalidRegistration = errors.New("invalid message registration")
+)
+
+// a error for a message type registered twice
+type DuplicateTypeError struct {
+	Type       uint8
+	Registered string // name of the message that has the type
+	Name       string // name of the message that asked for it
+}
+
+func (e *DuplicateTypeError) Error() string {
+	return fmt.Sprintf("message type %d of %s is already registered by %s", e.Type, e.Name, e.Registered)
+}
+
+func (e *DuplicateTypeError) Is(target error) bool {
+	return target == ErrDuplicateType
+}
+
+// a error for a registration without a constructor or with an unknown framing
+type InvalidRegistrationError struct {
+	Type uint8
+	Name string
+}
+
+func (e *InvalidRegistrationError) Error() string {
+	return fmt.Sprintf("invalid registration of message type %d (%s)", e.Type, e.Name)
+}
+
+func (e *InvalidRegistrationError) Is(target error) bool {
+	return target == ErrInvalidRegistration
+}
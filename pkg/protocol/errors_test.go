@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// frames that are cut short, too large or of an unknown type come out of a Decoder as the typed errors
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		max    int   // WithMaxFrameSize, 0 means no limit
+		target error // the sentinel the error matches
+		want   error
+	}{
+		{"unknown type", []byte{200, 1, 2}, 0, ErrUnknownType, &UnknownTypeError{200}},
+		{"fixed cut short", []byte{HelloCommandType, 0}, 0, ErrTruncated, &TruncatedError{HelloCommandType, 3, 2}},
+		{"fixed without body", []byte{ExtHelloCommandType}, 0, ErrTruncated, &TruncatedError{ExtHelloCommandType, 8, 1}},
+		{"string cut short", []byte{AnnounceReplyType, 5, 'a', 'b'}, 0, ErrTruncated, &TruncatedError{AnnounceReplyType, 7, 4}},
+		{"8-bit length missing", []byte{AnnounceReplyType}, 0, ErrTruncated, &TruncatedError{AnnounceReplyType, 2, 1}},
+		{"16-bit length cut short", []byte{LongAnnounceReplyType, 1}, 0, ErrTruncated, &TruncatedError{LongAnnounceReplyType, 3, 2}},
+		{"16-bit string cut short", []byte{LongAnnounceReplyType, 1, 0, 'a'}, 0, ErrTruncated, &TruncatedError{LongAnnounceReplyType, 259, 4}},
+		{"string too large", []byte{AnnounceReplyType, 200}, 64, ErrOversized, &OversizedError{AnnounceReplyType, 202, 64}},
+		{"16-bit string too large", []byte{LongAnnounceReplyType, 0xff, 0xff}, 1024, ErrOversized, &OversizedError{LongAnnounceReplyType, 65538, 1024}},
+		{"fixed too large", []byte{ExtWelcomeReplyType}, 4, ErrOversized, &OversizedError{ExtWelcomeReplyType, 8, 4}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewDecoder(bytes.NewReader(test.data), WithMaxFrameSize(test.max)).Decode(context.Background())
+			if !errors.Is(err, test.target) {
+				t.Fatalf("got %v, want %v", err, test.target)
+			}
+			if err.Error() != test.want.Error() {
+				t.Errorf("got %q, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+// a frame that fits the limit is read
+func TestDecodeMaxFrameSize(t *testing.T) {
+	data := append([]byte{AnnounceReplyType, 62}, bytes.Repeat([]byte("a"), 62)...)
+	m, err := NewDecoder(bytes.NewReader(data), WithMaxFrameSize(64)).Decode(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.(*Announce).Songname) != 62 {
+		t.Errorf("got %d bytes", len(m.(*Announce).Songname))
+	}
+}
+
+// a read that times out is a TimeoutError, which is partial if part of a message had arrived
+func TestDecodeTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		sent    []byte
+		timeout time.Duration // of ctx, 0 means no deadline
+		partial bool
+	}{
+		{"nothing sent", nil, 20 * time.Millisecond, false},
+		{"slow frame", []byte{HelloCommandType}, 0, true},
+		{"slow frame with deadline", []byte{HelloCommandType, 0}, time.Second, true},
+		{"slow string", []byte{AnnounceReplyType, 10, 'a'}, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go client.Write(test.sent)
+			ctx := context.Background()
+			if test.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				defer cancel()
+			}
+			_, err := NewDecoder(server, WithFrameTimeout(20*time.Millisecond)).Decode(ctx)
+			if !errors.Is(err, ErrTimeout) {
+				t.Fatalf("got %v, want a timeout", err)
+			}
+			var timeout *TimeoutError
+			if !errors.As(err, &timeout) || timeout.Partial != test.partial {
+				t.Errorf("got %v, want partial %v", err, test.partial)
+			}
+		})
+	}
+}
+
+// each typed error matches its own sentinel and no other
+func TestErrorsIs(t *testing.T) {
+	sentinels := []error{ErrUnknownType, ErrTruncated, ErrOversized, ErrTimeout, ErrUnexpected, ErrDuplicateType, ErrInvalidRegistration}
+	tests := []struct {
+		err    error
+		target error
+	}{
+		{&UnknownTypeError{200}, ErrUnknownType},
+		{&TruncatedError{HelloCommandType, 3, 1}, ErrTruncated},
+		{&OversizedError{AnnounceReplyType, 300, MaxStringSize}, ErrOversized},
+		{&TimeoutError{Err: context.DeadlineExceeded}, ErrTimeout},
+		{&UnexpectedMessageError{WelcomeReplyType, "session"}, ErrUnexpected},
+		{&DuplicateTypeError{HelloCommandType, "Hello", "Other"}, ErrDuplicateType},
+		{&InvalidRegistrationError{200, "Other"}, ErrInvalidRegistration},
+	}
+	for _, test := range tests {
+		for _, sentinel := range sentinels {
+			if errors.Is(test.err, sentinel) != (sentinel == test.target) {
+				t.Errorf("errors.Is(%q, %q) = %v", test.err, sentinel, !(sentinel == test.target))
+			}
+		}
+	}
+}
+
+func TestUnexpectedMessageError(t *testing.T) {
+	var err error = &UnexpectedMessageError{Type: WelcomeReplyType, State: "handshake"}
+	want := "unexpected message of type 2 during handshake"
+	if err.Error() != want {
+		t.Errorf("got %q, want %q", err, want)
+	}
+	var unexpected *UnexpectedMessageError
+	if !errors.As(err, &unexpected) || unexpected.Type != WelcomeReplyType {
+		t.Errorf("errors.As failed on %v", err)
+	}
+}
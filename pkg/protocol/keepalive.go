@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"encoding/binary"
+)
+
+// ======================================== Keepalive Messages ========================================
+
+// message which asks the peer to prove it is still there, only sent if FeatureKeepalive was granted
+// either side can send it, the other side answers with a Pong carrying the same sequence number
+type Ping struct {
+	messageType uint8
+	Seq         uint32 // offset is 1
+}
+
+func NewPing(seq uint32) *Ping {
+	return &Ping{PingMessageType, seq}
+}
+
+func (p *Ping) Marshal() ([]byte, error) {
+	buf := make([]byte, 5)
+	buf[0] = p.messageType
+	binary.BigEndian.PutUint32(buf[1:], p.Seq)
+	return buf, nil
+}
+
+func (p *Ping) Unmarshal(data []byte) {
+	p.messageType = PingMessageType
+	p.Seq = binary.BigEndian.Uint32(data[1:])
+}
+
+func (p *Ping) GetType() uint8 {
+	return p.messageType
+}
+
+// message which answers a Ping
+type Pong struct {
+	messageType uint8
+	Seq         uint32 // offset is 1, the sequence number of the Ping
+}
+
+func NewPong(seq uint32) *Pong {
+	return &Pong{PongMessageType, seq}
+}
+
+func (p *Pong) Marshal() ([]byte, error) {
+	buf := make([]byte, 5)
+	buf[0] = p.messageType
+	binary.BigEndian.PutUint32(buf[1:], p.Seq)
+	return buf, nil
+}
+
+func (p *Pong) Unmarshal(data []byte) {
+	p.messageType = PongMessageType
+	p.Seq = binary.BigEndian.Uint32(data[1:])
+}
+
+func (p *Pong) GetType() uint8 {
+	return p.messageType
+}
+
+// ======================================== Keepalive Messages ========================================
@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"strings"
+	"unicode/utf8"
+)
+
+// ======================================== Version 3 Replies ========================================
+
+// a reply carrying a string of up to MaxLongStringSize bytes behind a 16-bit length
+// it is the version 3 framing of Announce, InvalidCommand and StationsReply
+type LongString struct {
+	replyType uint8
+	size      uint16
+	String    []byte // offset is 3
+}
+
+func newLongString(replyType uint8, s string) (*LongString, error) {
+	if len(s) > MaxLongStringSize {
+		return nil, &OversizedError{replyType, len(s), MaxLongStringSize}
+	}
+	return &LongString{replyType, uint16(len(s)), []byte(s)}, nil
+}
+
+func NewLongAnnounce(songname string) (*LongString, error) {
+	return newLongString(LongAnnounceReplyType, songname)
+}
+
+func NewLongInvalidCommand(replyString string) (*LongString, error) {
+	return newLongString(LongInvalidCommandReplyType, replyString)
+}
+
+func NewLongStationsReply(replyString string) (*LongString, error) {
+	return newLongString(LongStationsReplyType, replyString)
+}
+
+func (l *LongString) Marshal() ([]byte, error) {
+	buf := make([]byte, 3+len(l.String))
+	buf[0] = l.replyType
+	binary.BigEndian.PutUint16(buf[1:], l.size)
+	copy(buf[3:], l.String)
+	return buf, nil
+}
+
+func (l *LongString) Unmarshal(data []byte) {
+	l.replyType = data[0]
+	l.size = binary.BigEndian.Uint16(data[1:])
+	l.String = data[3:]
+}
+
+func (l *LongString) GetType() uint8 {
+	return l.replyType
+}
+
+// ======================================== Version 3 Replies ========================================
+
+// return the longest string a client of the given version can receive in one reply
+func maxString(version uint8) int {
+	if version >= Version3 {
+		return MaxLongStringSize
+	}
+	return MaxStringSize
+}
+
+// cut a string to at most max bytes without splitting a UTF-8 character
+func Truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// build an Announce for a client of the given version, a name too long for it is truncated
+func AnnounceFor(version uint8, songname string) (Message, error) {
+	songname = Truncate(songname, maxString(version))
+	if version >= Version3 {
+		return NewLongAnnounce(songname)
+	}
+	return NewAnnounce(songname)
+}
+
+// build an InvalidCommand for a client of the given version, a reason too long for it is truncated
+func InvalidCommandFor(version uint8, reason string) (Message, error) {
+	reason = Truncate(reason, maxString(version))
+	if version >= Version3 {
+		return NewLongInvalidCommand(reason)
+	}
+	return NewInvalidCommand(reason)
+}
+
+// split a listing of lines into as many StationsReply messages as a client of the given version needs
+// pages break between lines, a single line too long for a page is truncated
+func StationsRepliesFor(version uint8, listing string) ([]Message, error) {
+	max := maxString(version)
+	var pages []string
+	var page strings.Builder
+	for _, line := range strings.SplitAfter(listing, "\n") {
+		if line == "" {
+			continue
+		}
+		line = Truncate(line, max)
+		if page.Len()+len(line) > max {
+			pages = append(pages, page.String())
+			page.Reset()
+		}
+		page.WriteString(line)
+	}
+	if page.Len() > 0 || len(pages) == 0 {
+		pages = append(pages, page.String())
+	}
+	replies := make([]Message, len(pages))
+	for i, p := range pages {
+		var err error
+		if version >= Version3 {
+			replies[i], err = NewLongStationsReply(p)
+		} else {
+			replies[i], err = NewStationsReply(p)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
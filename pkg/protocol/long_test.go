@@ -0,0 +1,181 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// a LongString is the type, a 16-bit big-endian length and the string, for each of the three long replies
+func TestLongStringEncoding(t *testing.T) {
+	long := strings.Repeat("a", MaxStringSize+1) // too long for the 8-bit length of version 2
+	tests := []struct {
+		name string
+		new  func(string) (*LongString, error)
+		typ  uint8
+		s    string
+	}{
+		{"LongAnnounce", NewLongAnnounce, LongAnnounceReplyType, "song.mp3"},
+		{"LongInvalidCommand", NewLongInvalidCommand, LongInvalidCommandReplyType, long},
+		{"LongStationsReply", NewLongStationsReply, LongStationsReplyType, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, err := test.new(test.s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := l.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := append([]byte{test.typ, byte(len(test.s) >> 8), byte(len(test.s))}, test.s...)
+			if !bytes.Equal(data, want) {
+				t.Fatalf("got % x, want % x", data, want)
+			}
+			var got LongString
+			got.Unmarshal(data)
+			if got.GetType() != test.typ || string(got.String) != test.s {
+				t.Errorf("got type %d and %q, want type %d and %q", got.GetType(), got.String, test.typ, test.s)
+			}
+		})
+	}
+}
+
+// the constructors refuse a string longer than its length can describe instead of truncating it
+func TestStringsTooLong(t *testing.T) {
+	short := strings.Repeat("a", MaxStringSize+1)
+	long := strings.Repeat("a", MaxLongStringSize+1)
+	tests := []struct {
+		name string
+		new  func() error
+		typ  uint8
+		max  int
+	}{
+		{"Announce", func() error { _, err := NewAnnounce(short); return err }, AnnounceReplyType, MaxStringSize},
+		{"InvalidCommand", func() error { _, err := NewInvalidCommand(short); return err }, InvalidCommandReplyType, MaxStringSize},
+		{"StationsReply", func() error { _, err := NewStationsReply(short); return err }, StationsReplyType, MaxStringSize},
+		{"Goodbye", func() error { _, err := NewGoodbye(short); return err }, GoodbyeMessageType, MaxStringSize},
+		{"Group", func() error { _, err := NewGroup(short); return err }, GroupReplyType, MaxStringSize},
+		{"LongAnnounce", func() error { _, err := NewLongAnnounce(long); return err }, LongAnnounceReplyType, MaxLongStringSize},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.new()
+			var oversized *OversizedError
+			if !errors.As(err, &oversized) {
+				t.Fatalf("got %v, want an OversizedError", err)
+			}
+			if oversized.Type != test.typ || oversized.Size != test.max+1 || oversized.Max != test.max {
+				t.Errorf("got %+v, want type %d, size %d and max %d", oversized, test.typ, test.max+1, test.max)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{"abc", 5, "abc"},
+		{"abc", 3, "abc"},
+		{"abc", 2, "ab"},
+		{"aé", 2, "a"}, // é is 2 bytes, so cutting after 2 bytes would split it
+		{"é", 1, ""},
+		{"日本", 5, "日"},
+		{"abc", 0, ""},
+	}
+	for _, test := range tests {
+		got := Truncate(test.s, test.max)
+		if got != test.want {
+			t.Errorf("Truncate(%q, %d) = %q, want %q", test.s, test.max, got, test.want)
+		}
+	}
+}
+
+// a client of version 3 or later gets the long replies, others get names truncated to MaxStringSize
+func TestAnnounceFor(t *testing.T) {
+	name := strings.Repeat("a", MaxStringSize+10)
+	tests := []struct {
+		version uint8
+		typ     uint8
+		want    string
+	}{
+		{Version1, AnnounceReplyType, name[:MaxStringSize]},
+		{Version2, AnnounceReplyType, name[:MaxStringSize]},
+		{Version3, LongAnnounceReplyType, name},
+		{Version4, LongAnnounceReplyType, name},
+	}
+	for _, test := range tests {
+		m, err := AnnounceFor(test.version, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		switch m := m.(type) {
+		case *Announce:
+			got = string(m.Songname)
+		case *LongString:
+			got = string(m.String)
+		}
+		if m.GetType() != test.typ || got != test.want {
+			t.Errorf("version %d: got type %d with %d bytes, want type %d with %d bytes",
+				test.version, m.GetType(), len(got), test.typ, len(test.want))
+		}
+	}
+}
+
+// a listing is split between lines into pages that fit in one reply each
+func TestStationsRepliesFor(t *testing.T) {
+	line := strings.Repeat("a", 99) + "\n" // 100 bytes
+	tests := []struct {
+		name    string
+		version uint8
+		listing string
+		pages   []string
+	}{
+		{"empty", Version2, "", []string{""}},
+		{"one line", Version2, line, []string{line}},
+		{"fits", Version2, line + line, []string{line + line}},
+		{"two pages", Version2, line + line + line, []string{line + line, line}},
+		{"long replies", Version3, strings.Repeat(line, 3), []string{strings.Repeat(line, 3)}},
+		{"no final newline", Version2, line + line + line + "end", []string{line + line, line + "end"}},
+		{"line too long", Version2, strings.Repeat("b", 300) + "\n" + line, []string{strings.Repeat("b", MaxStringSize), line}},
+		{"many pages", Version3, strings.Repeat(line, 1000), []string{strings.Repeat(line, 655), strings.Repeat(line, 345)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			replies, err := StationsRepliesFor(test.version, test.listing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(replies) != len(test.pages) {
+				t.Fatalf("got %d pages, want %d", len(replies), len(test.pages))
+			}
+			for i, m := range replies {
+				var got string
+				switch m := m.(type) {
+				case *StationsReply:
+					got = string(m.ReplyString)
+				case *LongString:
+					if m.GetType() != LongStationsReplyType {
+						t.Fatalf("page %d has type %d", i, m.GetType())
+					}
+					got = string(m.String)
+				default:
+					t.Fatalf("page %d is a %T", i, m)
+				}
+				if got != test.pages[i] {
+					t.Errorf("page %d has %d bytes, want %d", i, len(got), len(test.pages[i]))
+				}
+				if !utf8.ValidString(got) {
+					t.Errorf("page %d is not valid UTF-8", i)
+				}
+			}
+		})
+	}
+}
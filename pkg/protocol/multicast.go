@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// ======================================== Group Reply ========================================
+
+// reply which tells a client that asked for FeatureMulticast where the song data of its new station goes
+// the server sends it before the Announce that answers a SetStation
+type Group struct {
+	replyType   uint8
+	addressSize uint8
+	Address     []byte // offset is 2, "host:port" of the multicast group, empty if the station is sent to the UDP port of the client
+}
+
+// return an OversizedError rather than truncating an address longer than MaxStringSize
+func NewGroup(address string) (*Group, error) {
+	if len(address) > MaxStringSize {
+		return nil, &OversizedError{GroupReplyType, len(address), MaxStringSize}
+	}
+	return &Group{GroupReplyType, uint8(len(address)), []byte(address)}, nil
+}
+
+func (g *Group) Marshal() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, g.replyType)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(buf, binary.BigEndian, g.addressSize)
+	if err != nil {
+		return nil, err
+	}
+	_, err = buf.Write(g.Address)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (g *Group) Unmarshal(data []byte) {
+	g.replyType = GroupReplyType
+	g.addressSize = data[1]
+	g.Address = data[2:]
+}
+
+func (g *Group) GetType() uint8 {
+	return g.replyType
+}
+
+// ======================================== Group Reply ========================================
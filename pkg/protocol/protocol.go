@@ -3,10 +3,6 @@ package protocol
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
-	"io"
-	"net"
-	"time"
 )
 
 const (
@@ -15,12 +11,33 @@ const (
 	WelcomeReplyType        uint8 = 2
 	AnnounceReplyType       uint8 = 3
 	InvalidCommandReplyType uint8 = 4
-	MessageTypeBound        uint8 = 4 // the upper boundary of types of standard messages
+	// extended handshake, only used by clients that speak a later version of the protocol
+	ExtHelloCommandType uint8 = 5 // a Hello that also carries a protocol version and asks for optional features
+	ExtWelcomeReplyType uint8 = 6 // a Welcome that also carries the agreed version and grants optional features
+	// replies with 16-bit lengths, only sent to clients that speak version 3 or later
+	LongAnnounceReplyType       uint8 = 7
+	LongInvalidCommandReplyType uint8 = 8
+	LongStationsReplyType       uint8 = 9
+	// session control, only used by clients that speak version 4 or later
+	LeaveCommandType   uint8 = 10 // stop listening to the current station and keep the session open
+	GoodbyeMessageType uint8 = 11 // sent by either side before closing the connection, with a reason
+	// keepalive, only used by peers that agreed on FeatureKeepalive
+	PingMessageType uint8 = 12 // ask the peer to answer with a Pong
+	PongMessageType uint8 = 13 // answer a Ping
+	// multicast, only sent to clients that agreed on FeatureMulticast
+	GroupReplyType uint8 = 14 // tell the client which multicast group its station is sent to
+	// registration, only sent to clients that agreed on FeatureRegister
+	TokenReplyType uint8 = 15 // give the client a token its listener registers with
 	// addition to the protocol fot extra credit
 	StationsCommandType uint8 = 254 // request a listing of what each of the stations is currently playing
 	StationsReplyType   uint8 = 255 // return a listing of what each of the stations is currently playing
 )
 
+const (
+	MaxStringSize     = 255   // the longest string of an Announce, InvalidCommand or StationsReply
+	MaxLongStringSize = 65535 // the longest string of a LongAnnounce, LongInvalidCommand or LongStationsReply
+)
+
 // a interface to represent commands or replies
 type Message interface {
 	GetType() uint8           // return type of command or reply
@@ -165,8 +182,12 @@ type Announce struct {
 	// buf.Write([]byte(a.Songname))
 }
 
-func NewAnnounce(songname string) *Announce {
-	return &Announce{AnnounceReplyType, uint8(len(songname)), []byte(songname)}
+// return an OversizedError rather than truncating a song name longer than MaxStringSize
+func NewAnnounce(songname string) (*Announce, error) {
+	if len(songname) > MaxStringSize {
+		return nil, &OversizedError{AnnounceReplyType, len(songname), MaxStringSize}
+	}
+	return &Announce{AnnounceReplyType, uint8(len(songname)), []byte(songname)}, nil
 }
 
 func (a *Announce) Marshal() ([]byte, error) {
@@ -206,8 +227,12 @@ type InvalidCommand struct {
 	ReplyString     []byte // offset is 2
 }
 
-func NewInvalidCommand(replyString string) *InvalidCommand {
-	return &InvalidCommand{InvalidCommandReplyType, uint8(len(replyString)), []byte(replyString)}
+// return an OversizedError rather than truncating a reply string longer than MaxStringSize
+func NewInvalidCommand(replyString string) (*InvalidCommand, error) {
+	if len(replyString) > MaxStringSize {
+		return nil, &OversizedError{InvalidCommandReplyType, len(replyString), MaxStringSize}
+	}
+	return &InvalidCommand{InvalidCommandReplyType, uint8(len(replyString)), []byte(replyString)}, nil
 }
 
 func (i *InvalidCommand) Marshal() ([]byte, error) {
@@ -239,101 +264,127 @@ func (i *InvalidCommand) GetType() uint8 {
 
 // ======================================== InvalidCommand Reply ========================================
 
-func WriteMessage(conn net.Conn, m Message) (int, error) {
-	buf, err := m.Marshal() // marshal message into a byte array
-	if err != nil {
-		return 0, err
-	}
-	n, err := conn.Write(buf) // send it
-	return n, err
+// ======================================== ExtHello Command     ========================================
+
+const (
+	Version1        uint8 = 1        // the standard protocol, a client that sends a Hello speaks it
+	Version2        uint8 = 2        // adds the extended handshake
+	Version3        uint8 = 3        // adds replies with 16-bit lengths
+	Version4        uint8 = 4        // adds Leave and Goodbye
+	ProtocolVersion uint8 = Version4 // the latest version this implementation speaks
+)
+
+// optional features a client can ask for in an ExtHello and the server can grant in an ExtWelcome
+const (
+	FeatureDataHeader uint32 = 1 << 0 // prefix each UDP datagram with a DataHeader
+	FeatureKeepalive  uint32 = 1 << 1 // exchange Ping and Pong messages, so a peer that is gone is noticed
+	FeatureMulticast  uint32 = 1 << 2 // receive stations that have a multicast group from the group instead of the UDP port
+	FeatureRegister   uint32 = 1 << 3 // song data goes to the address a listener registers from instead of the UDP port in the hello
+)
+
+// a Hello that also carries a protocol version and asks for optional features, the server answers with an ExtWelcome
+type ExtHello struct {
+	commandType uint8
+	UdpPort     uint16 // offset is 1
+	Version     uint8  // offset is 3, the latest version the client speaks
+	Features    uint32 // offset is 4, a bitmap of the features the client asks for
 }
 
-func readMessageType(conn net.Conn, timeout bool) (uint8, error) {
-	buf := make([]byte, 1)
-	var t time.Time
-	if timeout {
-		t = time.Now().Add(100 * time.Millisecond) // the deadline for io.ReadFull call
-	} else {
-		t = time.Time{} //  a zero value for t means Read will not time out.
-	}
-	conn.SetReadDeadline(t)
-	_, err := io.ReadFull(conn, buf)
-	return buf[0], err
+func NewExtHello(udpPort uint16, version uint8, features uint32) *ExtHello {
+	return &ExtHello{ExtHelloCommandType, udpPort, version, features}
 }
 
-func ReadMessage(conn net.Conn, timeout bool) (any, error) {
-	t, err := readMessageType(conn, timeout) // read message type
+func (h *ExtHello) Marshal() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, h.commandType)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(buf, binary.BigEndian, h.UdpPort)
 	if err != nil {
 		return nil, err
 	}
-	// check whether t is a valid message type
-	if t > MessageTypeBound && t != StationsCommandType && t != StationsReplyType {
-		return nil, errors.New("unknown message type")
+	err = binary.Write(buf, binary.BigEndian, h.Version)
+	if err != nil {
+		return nil, err
 	}
-	var offset uint8 = 1 // starting position of remaining part of Hello/SetStation/Welcome/StationsCommand in the buffer
-	var remain uint8 = 2 // size of remaining part of Hello/SetStation/Welcome/StationsCommand
-	var buf []byte
-	if t == AnnounceReplyType || t == InvalidCommandReplyType || t == StationsReplyType {
-		sizeBuf := make([]byte, 1)                                   // the buffer for the size of the remaining part of the message
-		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)) // the deadline for io.ReadFull call
-		_, err = io.ReadFull(conn, sizeBuf)                          // read size of remaining part
-		if err != nil {
-			return nil, err
-		}
-		offset = 2                        // starting position of remaining part of AnnounceReplyType/InvalidCommandReplyType/StationsReplyType in the buffer
-		remain = sizeBuf[0]               // size of remaining part of AnnounceReplyType/InvalidCommandReplyType/StationsReplyType
-		buf = make([]byte, offset+remain) // the buffer for the message
-		buf[0] = t                        // message type
-		buf[1] = byte(remain)             // string size
-	} else {
-		buf = make([]byte, offset+remain) // the buffer for the message
-		buf[0] = t                        // message type
+	err = binary.Write(buf, binary.BigEndian, h.Features)
+	if err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)) // receive all of the remaining bytes of the message within the next 100 milliseconds
-	n, err := io.ReadFull(conn, buf[offset:])                    // read the remaining bytes and store them in the buffer beginning at offset
+func (h *ExtHello) Unmarshal(data []byte) {
+	h.commandType = ExtHelloCommandType
+	h.UdpPort = binary.BigEndian.Uint16(data[1:])
+	h.Version = data[3]
+	h.Features = binary.BigEndian.Uint32(data[4:])
+}
 
-	if err == io.EOF {
+func (h *ExtHello) GetType() uint8 {
+	return h.commandType
+}
+
+// ======================================== ExtHello Command   ========================================
+
+// ======================================== ExtWelcome Reply   ========================================
+
+// a Welcome that also carries the version both sides speak and grants the features both sides support
+type ExtWelcome struct {
+	replyType   uint8
+	NumStations uint16 // offset is 1
+	Version     uint8  // offset is 3, the lower of the versions of the client and the server
+	Features    uint32 // offset is 4, the intersection of the features asked for and the features of the server
+}
+
+func NewExtWelcome(numStations uint16, version uint8, features uint32) *ExtWelcome {
+	return &ExtWelcome{ExtWelcomeReplyType, numStations, version, features}
+}
+
+func (w *ExtWelcome) Marshal() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, w.replyType)
+	if err != nil {
 		return nil, err
-	} else if err != nil {
+	}
+	err = binary.Write(buf, binary.BigEndian, w.NumStations)
+	if err != nil {
 		return nil, err
-	} else if n != int(remain) { // invalid message length
+	}
+	err = binary.Write(buf, binary.BigEndian, w.Version)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(buf, binary.BigEndian, w.Features)
+	if err != nil {
 		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	switch t {
-	case HelloCommandType:
-		var h Hello
-		h.Unmarshal(buf)
-		return &h, nil
-	case SetStationCommandType:
-		var s SetStation
-		s.Unmarshal(buf)
-		return &s, nil
-	case WelcomeReplyType:
-		var w Welcome
-		w.Unmarshal(buf)
-		return &w, nil
-	case AnnounceReplyType:
-		var a Announce
-		a.Unmarshal(buf)
-		return &a, nil
-	case InvalidCommandReplyType:
-		var i InvalidCommand
-		i.Unmarshal(buf)
-		return &i, nil
-	case StationsCommandType:
-		var s StationsCommand
-		s.Unmarshal(buf)
-		return &s, nil
-	case StationsReplyType:
-		var s StationsReply
-		s.Unmarshal(buf)
-		return &s, nil
+func (w *ExtWelcome) Unmarshal(data []byte) {
+	w.replyType = ExtWelcomeReplyType
+	w.NumStations = binary.BigEndian.Uint16(data[1:])
+	w.Version = data[3]
+	w.Features = binary.BigEndian.Uint32(data[4:])
+}
+
+func (w *ExtWelcome) GetType() uint8 {
+	return w.replyType
+}
+
+// return the version and features both sides agree on, given what a client asked for and what a server supports
+func Negotiate(clientVersion uint8, clientFeatures uint32, serverVersion uint8, serverFeatures uint32) (uint8, uint32) {
+	version := clientVersion
+	if serverVersion < version {
+		version = serverVersion
 	}
-	return nil, nil // MissingReturn
+	return version, clientFeatures & serverFeatures
 }
 
+// ======================================== ExtWelcome Reply     ========================================
+
 // ======================================== Extra Credit     ========================================
 
 // ======================================== Stations Command ========================================
@@ -341,7 +392,7 @@ func ReadMessage(conn net.Conn, timeout bool) (any, error) {
 // command which requests a listing of what each of the stations is currently playing
 type StationsCommand struct {
 	commandType uint8
-	none        uint16 // it is required by the ReadMessage function
+	none        uint16 // keeps the command 3 bytes long, as registered
 }
 
 func NewStationsCommand() *SetStation {
@@ -381,8 +432,12 @@ type StationsReply struct {
 	ReplyString     []byte // offset is 2
 }
 
-func NewStationsReply(replyString string) *StationsReply {
-	return &StationsReply{StationsReplyType, uint8(len(replyString)), []byte(replyString)}
+// return an OversizedError rather than truncating a reply string longer than MaxStringSize
+func NewStationsReply(replyString string) (*StationsReply, error) {
+	if len(replyString) > MaxStringSize {
+		return nil, &OversizedError{StationsReplyType, len(replyString), MaxStringSize}
+	}
+	return &StationsReply{StationsReplyType, uint8(len(replyString)), []byte(replyString)}, nil
 }
 
 func (i *StationsReply) Marshal() ([]byte, error) {
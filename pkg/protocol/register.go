@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	TokenSize         = 24                                 // size of a registration token
+	registrationMagic = "SNOW"                             // the beginning of a registration datagram
+	RegistrationSize  = len(registrationMagic) + TokenSize // size of a registration datagram
+)
+
+// ======================================== Token Reply ========================================
+
+// reply which follows the ExtWelcome of a client that was granted FeatureRegister
+// the listener sends the token to the registration port of the server, which then sends song data back to
+// the address the datagram came from, so it gets through a NAT and can run on another host than the client
+type Token struct {
+	replyType uint8
+	Port      uint16 // offset is 1, UDP port of the server to send registration datagrams to
+	Token     []byte // offset is 3, TokenSize bytes
+}
+
+func NewToken(port uint16, token []byte) *Token {
+	return &Token{TokenReplyType, port, token}
+}
+
+func (t *Token) Marshal() ([]byte, error) {
+	if len(t.Token) != TokenSize {
+		return nil, errors.New("invalid token size")
+	}
+	buf := make([]byte, 3+TokenSize)
+	buf[0] = t.replyType
+	binary.BigEndian.PutUint16(buf[1:], t.Port)
+	copy(buf[3:], t.Token)
+	return buf, nil
+}
+
+func (t *Token) Unmarshal(data []byte) {
+	t.replyType = TokenReplyType
+	t.Port = binary.BigEndian.Uint16(data[1:])
+	t.Token = data[3:]
+}
+
+func (t *Token) GetType() uint8 {
+	return t.replyType
+}
+
+// ======================================== Token Reply ========================================
+
+// return the datagram a listener sends to the registration port of the server
+func MarshalRegistration(token []byte) []byte {
+	buf := make([]byte, 0, RegistrationSize)
+	buf = append(buf, registrationMagic...)
+	return append(buf, token...)
+}
+
+// return the token of a registration datagram
+func ParseRegistration(datagram []byte) ([]byte, error) {
+	if len(datagram) != RegistrationSize || !bytes.HasPrefix(datagram, []byte(registrationMagic)) {
+		return nil, errors.New("not a registration datagram")
+	}
+	return datagram[len(registrationMagic):], nil
+}
@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"sync"
+)
+
+// how the size of a message is known once its type has been read
+type Framing uint8
+
+const (
+	Fixed      Framing = iota // a fixed number of bytes follows the type
+	Prefixed8                 // a 1-byte length follows the type, then as many bytes
+	Prefixed16                // a 2-byte big-endian length follows the type, then as many bytes
+)
+
+// return the size of the length that follows the type
+func (f Framing) prefix() int {
+	switch f {
+	case Prefixed8:
+		return 1
+	case Prefixed16:
+		return 2
+	}
+	return 0
+}
+
+// a struct to describe a message type, so a Decoder knows how to frame and build it
+type Registration struct {
+	Type    uint8
+	Name    string         // e.g. "Hello", used in errors
+	Framing Framing        // how the size of the message is known
+	Size    int            // bytes after the type of a Fixed message, ignored otherwise
+	New     func() Message // return an empty message, the Decoder calls its Unmarshal with the whole message
+}
+
+// a struct to map type bytes to message types
+// a Decoder uses DefaultRegistry unless it is given another one with WithRegistry
+type Registry struct {
+	mutex sync.RWMutex
+	types [256]*Registration
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// add a message type, a type that is already taken returns a DuplicateTypeError
+func (r *Registry) Register(reg Registration) error {
+	if reg.New == nil || reg.Framing > Prefixed16 || reg.Size < 0 {
+		return &InvalidRegistrationError{reg.Type, reg.Name}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if old := r.types[reg.Type]; old != nil {
+		return &DuplicateTypeError{reg.Type, old.Name, reg.Name}
+	}
+	r.types[reg.Type] = &reg
+	return nil
+}
+
+// add a message type, or panic if it cannot be added, for use in package initialization
+func (r *Registry) MustRegister(reg Registration) {
+	err := r.Register(reg)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// return the description of a message type, or false if it is not registered
+func (r *Registry) Lookup(t uint8) (Registration, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	reg := r.types[t]
+	if reg == nil {
+		return Registration{}, false
+	}
+	return *reg, true
+}
+
+// return a copy that can be extended without changing r
+func (r *Registry) Clone() *Registry {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	c := NewRegistry()
+	c.types = r.types
+	return c
+}
+
+// the message types of this package, extensions add theirs with Register
+var DefaultRegistry = NewRegistry()
+
+// add a message type to DefaultRegistry
+func Register(reg Registration) error {
+	return DefaultRegistry.Register(reg)
+}
+
+func init() {
+	for _, reg := range []Registration{
+		{HelloCommandType, "Hello", Fixed, 2, func() Message { return new(Hello) }},
+		{SetStationCommandType, "SetStation", Fixed, 2, func() Message { return new(SetStation) }},
+		{WelcomeReplyType, "Welcome", Fixed, 2, func() Message { return new(Welcome) }},
+		{AnnounceReplyType, "Announce", Prefixed8, 0, func() Message { return new(Announce) }},
+		{InvalidCommandReplyType, "InvalidCommand", Prefixed8, 0, func() Message { return new(InvalidCommand) }},
+		{ExtHelloCommandType, "ExtHello", Fixed, 7, func() Message { return new(ExtHello) }},
+		{ExtWelcomeReplyType, "ExtWelcome", Fixed, 7, func() Message { return new(ExtWelcome) }},
+		{LongAnnounceReplyType, "LongAnnounce", Prefixed16, 0, func() Message { return new(LongString) }},
+		{LongInvalidCommandReplyType, "LongInvalidCommand", Prefixed16, 0, func() Message { return new(LongString) }},
+		{LongStationsReplyType, "LongStationsReply", Prefixed16, 0, func() Message { return new(LongString) }},
+		{LeaveCommandType, "Leave", Fixed, 0, func() Message { return new(Leave) }},
+		{GoodbyeMessageType, "Goodbye", Prefixed8, 0, func() Message { return new(Goodbye) }},
+		{PingMessageType, "Ping", Fixed, 4, func() Message { return new(Ping) }},
+		{PongMessageType, "Pong", Fixed, 4, func() Message { return new(Pong) }},
+		{GroupReplyType, "Group", Prefixed8, 0, func() Message { return new(Group) }},
+		{TokenReplyType, "Token", Fixed, 2 + TokenSize, func() Message { return new(Token) }},
+		{StationsCommandType, "StationsCommand", Fixed, 2, func() Message { return new(StationsCommand) }},
+		{StationsReplyType, "StationsReply", Prefixed8, 0, func() Message { return new(StationsReply) }},
+	} {
+		DefaultRegistry.MustRegister(reg)
+	}
+}
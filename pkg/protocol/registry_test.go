@@ -0,0 +1,124 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+// a message of an extension, a fixed 2-byte payload
+type testMessage struct {
+	data []byte
+}
+
+func (m *testMessage) Marshal() ([]byte, error) {
+	return m.data, nil
+}
+
+func (m *testMessage) Unmarshal(data []byte) {
+	m.data = data
+}
+
+func (m *testMessage) GetType() uint8 {
+	return m.data[0]
+}
+
+func newTestMessage() Message {
+	return new(testMessage)
+}
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name string
+		reg  Registration
+		want error // nil if the registration is accepted
+	}{
+		{"fixed", Registration{200, "Fixed", Fixed, 2, newTestMessage}, nil},
+		{"empty", Registration{201, "Empty", Fixed, 0, newTestMessage}, nil},
+		{"prefixed", Registration{202, "Prefixed", Prefixed16, 0, newTestMessage}, nil},
+		{"duplicate", Registration{HelloCommandType, "Other", Fixed, 2, newTestMessage}, ErrDuplicateType},
+		{"no constructor", Registration{203, "NoNew", Fixed, 2, nil}, ErrInvalidRegistration},
+		{"unknown framing", Registration{204, "Framing", Prefixed16 + 1, 0, newTestMessage}, ErrInvalidRegistration},
+		{"negative size", Registration{205, "Size", Fixed, -1, newTestMessage}, ErrInvalidRegistration},
+	}
+	registry := DefaultRegistry.Clone()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := registry.Register(test.reg)
+			if !errors.Is(err, test.want) || (test.want == nil) != (err == nil) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+			_, ok := registry.Lookup(test.reg.Type)
+			if test.want == ErrInvalidRegistration && ok {
+				t.Errorf("type %d was registered", test.reg.Type)
+			}
+		})
+	}
+}
+
+// a type registered twice keeps its first registration and names both in the error
+func TestRegisterDuplicate(t *testing.T) {
+	registry := NewRegistry()
+	registry.MustRegister(Registration{200, "First", Fixed, 2, newTestMessage})
+	err := registry.Register(Registration{200, "Second", Fixed, 4, newTestMessage})
+	var duplicate *DuplicateTypeError
+	if !errors.As(err, &duplicate) || duplicate.Type != 200 || duplicate.Registered != "First" || duplicate.Name != "Second" {
+		t.Fatalf("got %v, want a DuplicateTypeError", err)
+	}
+	reg, _ := registry.Lookup(200)
+	if reg.Name != "First" || reg.Size != 2 {
+		t.Errorf("got %+v, want the first registration", reg)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("MustRegister did not panic on a duplicate type")
+		}
+	}()
+	registry.MustRegister(Registration{200, "Third", Fixed, 2, newTestMessage})
+}
+
+// every message type of the protocol is in DefaultRegistry
+func TestDefaultRegistry(t *testing.T) {
+	for _, m := range messages() {
+		reg, ok := DefaultRegistry.Lookup(m.GetType())
+		if !ok {
+			t.Errorf("type %d is not registered", m.GetType())
+			continue
+		}
+		if reg.New().GetType() != 0 {
+			t.Errorf("New of type %d does not return an empty message", m.GetType())
+		}
+	}
+	_, ok := DefaultRegistry.Lookup(200)
+	if ok {
+		t.Error("type 200 is registered")
+	}
+}
+
+// a clone can be extended without changing the registry it was cloned from
+func TestClone(t *testing.T) {
+	registry := DefaultRegistry.Clone()
+	registry.MustRegister(Registration{200, "Extension", Fixed, 2, newTestMessage})
+	if _, ok := DefaultRegistry.Lookup(200); ok {
+		t.Fatal("registering in a clone changed DefaultRegistry")
+	}
+	if _, ok := registry.Lookup(HelloCommandType); !ok {
+		t.Fatal("the clone lost the types of DefaultRegistry")
+	}
+
+	// only a Decoder with the clone understands the extension
+	data := []byte{200, 'h', 'i'}
+	m, err := NewDecoder(bytes.NewReader(data), WithRegistry(registry)).Decode(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.(*testMessage).data, data) {
+		t.Errorf("got % x, want % x", m.(*testMessage).data, data)
+	}
+	_, err = NewDecoder(bytes.NewReader(data)).Decode(context.Background())
+	if !errors.Is(err, ErrUnknownType) {
+		t.Errorf("got %v from DefaultRegistry, want an UnknownTypeError", err)
+	}
+}
@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// ======================================== Version 4 Messages ========================================
+
+// command which stops listening to the current station, the session stays open
+type Leave struct {
+	commandType uint8
+}
+
+func NewLeave() *Leave {
+	return &Leave{LeaveCommandType}
+}
+
+func (l *Leave) Marshal() ([]byte, error) {
+	return []byte{l.commandType}, nil
+}
+
+func (l *Leave) Unmarshal(data []byte) {
+	l.commandType = LeaveCommandType
+}
+
+func (l *Leave) GetType() uint8 {
+	return l.commandType
+}
+
+// message which either side sends before closing the connection, with the reason why
+type Goodbye struct {
+	messageType uint8
+	reasonSize  uint8
+	Reason      []byte // offset is 2
+}
+
+// return an OversizedError rather than truncating a reason longer than MaxStringSize
+func NewGoodbye(reason string) (*Goodbye, error) {
+	if len(reason) > MaxStringSize {
+		return nil, &OversizedError{GoodbyeMessageType, len(reason), MaxStringSize}
+	}
+	return &Goodbye{GoodbyeMessageType, uint8(len(reason)), []byte(reason)}, nil
+}
+
+func (g *Goodbye) Marshal() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, g.messageType)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(buf, binary.BigEndian, g.reasonSize)
+	if err != nil {
+		return nil, err
+	}
+	_, err = buf.Write(g.Reason)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (g *Goodbye) Unmarshal(data []byte) {
+	g.messageType = GoodbyeMessageType
+	g.reasonSize = data[1]
+	g.Reason = data[2:]
+}
+
+func (g *Goodbye) GetType() uint8 {
+	return g.messageType
+}
+
+// ======================================== Version 4 Messages ========================================